@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+const (
+	// maxTileChanges caps the log entries read per request; clients continue
+	// from the returned sequence to read the rest.
+	maxTileChanges = 1000
+	// maxChangedTiles caps the tiles listed per response. Changes past it are
+	// returned as areas for the client to expand.
+	maxChangedTiles = 10000
+)
+
+// TileChangesDto is the response of /tiles/changes. Sequence is the since
+// value for the next request.
+type TileChangesDto struct {
+	Sequence  uint64              `json:"sequence"`
+	Truncated bool                `json:"truncated"`
+	Tiles     map[string][]string `json:"tiles"`
+	Areas     []TileChangeArea    `json:"areas,omitempty"`
+}
+
+// TileChangeArea is a change whose tiles from MinZoom to MaxZoom did not fit
+// in the response. Bbox is west, south, east, north.
+type TileChangeArea struct {
+	MergeId string     `json:"merge_id"`
+	Bbox    [4]float64 `json:"bbox"`
+	MinZoom int        `json:"min_zoom"`
+	MaxZoom int        `json:"max_zoom"`
+}
+
+// tilesChanged drops the cached tiles of the element and tells feed clients
+// to refetch them. Every change to the tile output goes through here.
+func (fi FeatureInterceptor) tilesChanged(element *IndexableElement) {
+	fi.invalidateTiles(element)
+	fi.logTileChange(element)
+}
+
+// logTileChange appends the element's bounding box to the change feed. The
+// write already happened, so failures are only logged.
+func (fi FeatureInterceptor) logTileChange(element *IndexableElement) {
+	bound := elementBound(element)
+	change := TileChange{
+		MergeId: element.Merge_id,
+		MinLon:  bound.Min[0],
+		MinLat:  bound.Min[1],
+		MaxLon:  bound.Max[0],
+		MaxLat:  bound.Max[1],
+	}
+	if err := fi.db.Create(&change).Error; err != nil {
+		log.Printf("logging tile change of %s: %v", element.Merge_id, err)
+	}
+}
+
+// tileChangesSince reads the change log after since, which is either a
+// sequence number or an RFC 3339 timestamp.
+func (fi FeatureInterceptor) tileChangesSince(since string) ([]TileChange, error) {
+	query := fi.db.Order("id").Limit(maxTileChanges + 1)
+
+	if sequence, err := strconv.ParseUint(since, 10, 64); err == nil {
+		query = query.Where("id > ?", sequence)
+	} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+		query = query.Where("created_at > ?", t)
+	} else {
+		return nil, errInvalidSince
+	}
+
+	changes := make([]TileChange, 0)
+	return changes, query.Find(&changes).Error
+}
+
+var errInvalidSince = fmt.Errorf("since must be a sequence number or an RFC 3339 timestamp")
+
+// changedTiles lists the z/x/y of every served tile covering the changes,
+// grouped by zoom. Once a zoom of a change would take the list past
+// maxChangedTiles, that zoom and the ones above it are returned as an area.
+func (fi FeatureInterceptor) changedTiles(changes []TileChange) (map[string][]string, []TileChangeArea) {
+	minZoom, maxZoom := fi.servedZoomRange()
+
+	seen := make(map[string]bool)
+	tiles := make(map[string][]string)
+	areas := make([]TileChangeArea, 0)
+	for _, change := range changes {
+		bound := orb.Bound{Min: orb.Point{change.MinLon, change.MinLat}, Max: orb.Point{change.MaxLon, change.MaxLat}}
+		for z := int(minZoom); z <= int(maxZoom); z++ {
+			minX, minY, maxX, maxY := tileRange(bound, uint8(z))
+			if uint64(len(seen))+(maxX-minX+1)*(maxY-minY+1) > maxChangedTiles {
+				areas = append(areas, TileChangeArea{
+					MergeId: change.MergeId,
+					Bbox:    [4]float64{change.MinLon, change.MinLat, change.MaxLon, change.MaxLat},
+					MinZoom: z,
+					MaxZoom: int(maxZoom),
+				})
+				break
+			}
+
+			for x := minX; x <= maxX; x++ {
+				for y := minY; y <= maxY; y++ {
+					tile := fmt.Sprintf("%d/%d/%d", z, x, y)
+					if !seen[tile] {
+						seen[tile] = true
+						zoom := strconv.Itoa(z)
+						tiles[zoom] = append(tiles[zoom], tile)
+					}
+				}
+			}
+		}
+	}
+
+	for _, list := range tiles {
+		sort.Strings(list)
+	}
+	return tiles, areas
+}
+
+// GetTileChanges serves /tiles/changes?since= with the tiles whose overlay
+// output changed after the given sequence number or timestamp.
+func (fi FeatureInterceptor) GetTileChanges(rw http.ResponseWriter, req *http.Request) {
+	since := req.URL.Query().Get("since")
+	if since == "" {
+		http.Error(rw, "Request Error since is required", http.StatusBadRequest)
+		return
+	}
+
+	changes, err := fi.tileChangesSince(since)
+	if err == errInvalidSince {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("reading tile changes since %s: %v", since, err)
+		http.Error(rw, "could not read tile changes", http.StatusInternalServerError)
+		return
+	}
+
+	dto := TileChangesDto{Tiles: map[string][]string{}}
+	if len(changes) > maxTileChanges {
+		changes = changes[:maxTileChanges]
+		dto.Truncated = true
+	}
+
+	if len(changes) > 0 {
+		dto.Sequence = changes[len(changes)-1].ID
+		dto.Tiles, dto.Areas = fi.changedTiles(changes)
+	} else if sequence, err := strconv.ParseUint(since, 10, 64); err == nil {
+		dto.Sequence = sequence
+	} else {
+		var last TileChange
+		if err := fi.db.Order("id desc").Limit(1).Find(&last).Error; err != nil {
+			log.Printf("reading tile change sequence: %v", err)
+		}
+		dto.Sequence = last.ID
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(&dto)
+	rw.Write(body)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"gorm.io/gorm"
+)
+
+const (
+	// clusterLayerName is the synthetic layer added to low zoom tiles.
+	clusterLayerName = "clusters"
+	// clusterGrid is the number of cluster cells along each side of a tile.
+	clusterGrid = 8
+)
+
+type clusterPoint struct {
+	mergeId string
+	name    string
+	views   uint64
+	point   orb.Point
+}
+
+// ClusterIndex holds the positions of customized or owned features, so that
+// low zoom tiles can show where they are after the buildings themselves have
+// been dropped from the tileset.
+type ClusterIndex struct {
+	mu     sync.RWMutex
+	points map[string]clusterPoint
+}
+
+func newClusterIndex() *ClusterIndex {
+	return &ClusterIndex{points: make(map[string]clusterPoint)}
+}
+
+// isClustered reports whether the feature is shown in the cluster layer.
+func isClustered(feature *Feature) bool {
+	return (feature.IsCustomized() || feature.Owner != "") && (feature.Lon != 0 || feature.Lat != 0)
+}
+
+// set adds, updates or removes the feature from the index.
+func (index *ClusterIndex) set(feature *Feature) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if !isClustered(feature) {
+		delete(index.points, feature.MergeId)
+		return
+	}
+	index.points[feature.MergeId] = clusterPoint{
+		mergeId: feature.MergeId,
+		name:    feature.Name,
+		views:   feature.Views,
+		point:   orb.Point{feature.Lon, feature.Lat},
+	}
+}
+
+// countView keeps the view count used to pick the top feature up to date. It
+// reports whether the feature is in the index.
+func (index *ClusterIndex) countView(mergeId string, views uint64) bool {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	p, ok := index.points[mergeId]
+	if ok {
+		p.views = views
+		index.points[mergeId] = p
+	}
+	return ok
+}
+
+// load fills the index from the Feature table. Rows saved before the center
+// was stored get it from the search index when there is one.
+func (index *ClusterIndex) load(db *gorm.DB, s *SearchServer) error {
+	batch := make([]Feature, 0)
+	return db.Model(&Feature{}).
+		Select("id", "merge_id", "name", "description", "embedded_link", "color", "link_to_vr", "owner", "views", "lon", "lat").
+		FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				feature := &batch[i]
+				if !feature.IsCustomized() && feature.Owner == "" {
+					continue
+				}
+
+				if err := fillFeatureCenter(db, s, feature); err != nil {
+					return err
+				}
+				index.set(feature)
+			}
+			return nil
+		}).Error
+}
+
+// fillFeatureCenter stores the center of the search index bounding box for
+// rows saved before the center was, when there is a search index to ask.
+// Features missing from the index keep a zero center and are skipped.
+func fillFeatureCenter(db *gorm.DB, s *SearchServer, feature *Feature) error {
+	if feature.Lon != 0 || feature.Lat != 0 || s == nil {
+		return nil
+	}
+
+	element, found := s.getElasticElement(feature.MergeId)
+	if !found {
+		return nil
+	}
+	center := elementBound(element).Center()
+	feature.Lon, feature.Lat = center[0], center[1]
+
+	err := db.Model(&Feature{}).Where("merge_id = ?", feature.MergeId).
+		Updates(map[string]interface{}{"lon": feature.Lon, "lat": feature.Lat}).Error
+	if err != nil {
+		return fmt.Errorf("storing center of %s: %v", feature.MergeId, err)
+	}
+	return nil
+}
+
+// tileLayer groups the points inside the tile into a grid of clusterGrid
+// cells. Each cluster sits at the mean position of its members and carries
+// the member count and the named member with the most views. It returns nil
+// when the tile contains no points.
+func (index *ClusterIndex) tileLayer(z uint8, x uint64, y uint64) *mvt.Layer {
+	tile := maptile.New(uint32(x), uint32(y), maptile.Zoom(z))
+	bound := tile.Bound()
+
+	cells := make(map[[2]int][]clusterPoint)
+	index.mu.RLock()
+	for _, p := range index.points {
+		if !bound.Contains(p.point) {
+			continue
+		}
+		f := maptile.Fraction(p.point, maptile.Zoom(z))
+		cell := [2]int{
+			int(math.Min(clusterGrid-1, (f[0]-float64(x))*clusterGrid)),
+			int(math.Min(clusterGrid-1, (f[1]-float64(y))*clusterGrid)),
+		}
+		cells[cell] = append(cells[cell], p)
+	}
+	index.mu.RUnlock()
+
+	if len(cells) == 0 {
+		return nil
+	}
+
+	// sorted so the same points always encode to the same tile
+	keys := make([][2]int, 0, len(cells))
+	for cell := range cells {
+		keys = append(keys, cell)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][1] < keys[j][1] || (keys[i][1] == keys[j][1] && keys[i][0] < keys[j][0])
+	})
+
+	fc := geojson.NewFeatureCollection()
+	for _, cell := range keys {
+		members := cells[cell]
+		var center orb.Point
+		top := members[0]
+		for _, p := range members {
+			center[0] += p.point[0] / float64(len(members))
+			center[1] += p.point[1] / float64(len(members))
+			if clusterRanksBefore(p, top) {
+				top = p
+			}
+		}
+
+		f := geojson.NewFeature(center)
+		f.Properties["count"] = len(members)
+		f.Properties["top_merge_id"] = top.mergeId
+		if top.name != "" {
+			f.Properties["top_name"] = top.name
+		}
+		fc.Append(f)
+	}
+
+	layer := mvt.NewLayer(clusterLayerName, fc)
+	layer.ProjectToTile(tile)
+	return layer
+}
+
+// clusterRanksBefore orders named features first, then by views, then by
+// merge_id to break ties.
+func clusterRanksBefore(a clusterPoint, b clusterPoint) bool {
+	if (a.name != "") != (b.name != "") {
+		return a.name != ""
+	}
+	if a.views != b.views {
+		return a.views > b.views
+	}
+	return a.mergeId < b.mergeId
+}
+
+// addClusterLayer appends the cluster layer to a rendered, possibly gzipped
+// tile. Layers are a repeated field of the tile message, so the encoded layer
+// is appended without decoding the tile.
+func (fi FeatureInterceptor) addClusterLayer(z uint8, x uint64, y uint64, tile []byte) ([]byte, error) {
+	if fi.clusters == nil || int(z) > fi.clusterMaxZoom {
+		return tile, nil
+	}
+
+	layer := fi.clusters.tileLayer(z, x, y)
+	if layer == nil {
+		return tile, nil
+	}
+
+	encoded, err := mvt.Marshal(mvt.Layers{layer})
+	if err != nil {
+		return nil, err
+	}
+
+	if isGzipped(tile) {
+		if tile, err = gunzipBytes(tile); err != nil {
+			return nil, err
+		}
+	}
+	return gzipBytes(append(tile, encoded...))
+}
+
+// clusterVectorLayer describes the cluster layer in the vector_layers of a
+// tileset spanning minZoom to maxZoom.
+func clusterVectorLayer(minZoom uint8, maxZoom uint8, clusterMaxZoom int) map[string]interface{} {
+	if clusterMaxZoom < int(maxZoom) {
+		maxZoom = uint8(clusterMaxZoom)
+	}
+	return map[string]interface{}{
+		"id":          clusterLayerName,
+		"description": "customized and owned features grouped per tile cell",
+		"minzoom":     minZoom,
+		"maxzoom":     maxZoom,
+		"fields": map[string]interface{}{
+			"count":        "Number",
+			"top_merge_id": "String",
+			"top_name":     "String",
+		},
+	}
+}
+
+// clusterStyleLayers draws the cluster layer as circles with the count and
+// the top feature name.
+func clusterStyleLayers(theme styleTheme, maxZoom int) []interface{} {
+	return []interface{}{
+		map[string]interface{}{
+			"id":           clusterLayerName + "-circle",
+			"type":         "circle",
+			"source":       styleSourceName,
+			"source-layer": clusterLayerName,
+			"maxzoom":      maxZoom + 1,
+			"paint": map[string]interface{}{
+				"circle-color":        theme.CustomText,
+				"circle-opacity":      0.8,
+				"circle-radius":       []interface{}{"interpolate", []interface{}{"linear"}, []interface{}{"get", "count"}, 1, 6, 100, 18},
+				"circle-stroke-color": theme.TextHalo,
+				"circle-stroke-width": 1,
+			},
+		},
+		map[string]interface{}{
+			"id":           clusterLayerName + "-label",
+			"type":         "symbol",
+			"source":       styleSourceName,
+			"source-layer": clusterLayerName,
+			"maxzoom":      maxZoom + 1,
+			"layout": map[string]interface{}{
+				"text-field": []interface{}{
+					"case", []interface{}{"has", "top_name"},
+					[]interface{}{"format", []interface{}{"get", "top_name"}, map[string]interface{}{}, " (", map[string]interface{}{}, []interface{}{"to-string", []interface{}{"get", "count"}}, map[string]interface{}{}, ")", map[string]interface{}{}},
+					[]interface{}{"to-string", []interface{}{"get", "count"}},
+				},
+				"text-font":   []string{"Open Sans Bold"},
+				"text-size":   12,
+				"text-offset": []float64{0, 1.4},
+			},
+			"paint": map[string]interface{}{
+				"text-color":      theme.CustomText,
+				"text-halo-color": theme.TextHalo,
+				"text-halo-width": 1.5,
+			},
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	b58 "github.com/mr-tron/base58/base58"
+)
+
+// Key types as NEAR prefixes them, e.g. "ed25519:<base58>".
+const (
+	keyTypeED25519   = "ed25519"
+	keyTypeSecp256k1 = "secp256k1"
+)
+
+// Signature encodings accepted in SignatureDto.SignatureEncoding.
+const (
+	signatureEncodingBase58 = "base58"
+	signatureEncodingBase64 = "base64"
+	signatureEncodingHex    = "hex"
+)
+
+const (
+	// NEAR stores secp256k1 keys as the 64 byte uncompressed point without
+	// the 0x04 prefix, and signatures as r, s and the recovery id.
+	secp256k1PublicKeySize = 64
+	secp256k1SignatureSize = 65
+)
+
+var errUnknownKeyType = errors.New("unknown key type")
+
+// PublicKey is an account key as listed by view_access_key_list.
+type PublicKey struct {
+	Type string
+	Data []byte
+}
+
+// ParsePublicKey reads a "<type>:<base58>" key. Keys without a type prefix
+// are ed25519, like NEAR treats them.
+func ParsePublicKey(s string) (PublicKey, error) {
+	keyType, encoded := keyTypeED25519, s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		keyType, encoded = s[:i], s[i+1:]
+	}
+
+	data, err := b58.Decode(encoded)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("decoding %s key: %v", keyType, err)
+	}
+
+	var size int
+	switch keyType {
+	case keyTypeED25519:
+		size = ed25519.PublicKeySize
+	case keyTypeSecp256k1:
+		size = secp256k1PublicKeySize
+	default:
+		return PublicKey{}, errUnknownKeyType
+	}
+	if len(data) != size {
+		return PublicKey{}, fmt.Errorf("%s key must be %d bytes, got %d", keyType, size, len(data))
+	}
+	return PublicKey{Type: keyType, Data: data}, nil
+}
+
+// String formats the key the way NEAR does.
+func (key PublicKey) String() string {
+	return key.Type + ":" + b58.Encode(key.Data)
+}
+
+// SignedMessage is what a key signed: the message itself, or with Digest set
+// a SHA-256 digest the signer computed, as NEP-413 signMessage does.
+type SignedMessage struct {
+	Data   []byte
+	Digest bool
+}
+
+// Verify checks the signature of message. ed25519 keys sign the data as it
+// is; secp256k1 keys sign a 32 byte digest, which is the SHA-256 of the data
+// unless the data is a digest already.
+func (key PublicKey) Verify(message SignedMessage, signature []byte) bool {
+	switch key.Type {
+	case keyTypeED25519:
+		return len(signature) == ed25519.SignatureSize && ed25519.Verify(key.Data, message.Data, signature)
+	case keyTypeSecp256k1:
+		if len(signature) != secp256k1SignatureSize {
+			return false
+		}
+		publicKey, err := secp256k1.ParsePubKey(append([]byte{0x04}, key.Data...))
+		if err != nil {
+			return false
+		}
+
+		var r, s secp256k1.ModNScalar
+		if r.SetByteSlice(signature[:32]) || s.SetByteSlice(signature[32:64]) {
+			return false
+		}
+
+		digest := message.Data
+		if !message.Digest {
+			sum := sha256.Sum256(message.Data)
+			digest = sum[:]
+		} else if len(digest) != sha256.Size {
+			return false
+		}
+		return ecdsa.NewSignature(&r, &s).Verify(digest, publicKey)
+	default:
+		return false
+	}
+}
+
+// DecodeSignature decodes a signature in the given encoding. Without an
+// encoding the signature is base58, optionally with a NEAR key type prefix
+// like "ed25519:<base58>", which is also accepted by the base58 encoding.
+func DecodeSignature(s string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", signatureEncodingBase58:
+		if i := strings.IndexByte(s, ':'); i >= 0 {
+			if keyType := s[:i]; keyType != keyTypeED25519 && keyType != keyTypeSecp256k1 {
+				return nil, errUnknownKeyType
+			}
+			s = s[i+1:]
+		}
+		return b58.Decode(s)
+	case signatureEncodingBase64:
+		return b64.StdEncoding.DecodeString(s)
+	case signatureEncodingHex:
+		return hex.DecodeString(s)
+	default:
+		return nil, fmt.Errorf("unknown signature encoding %q", encoding)
+	}
+}
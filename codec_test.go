@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// signatureVector is an entry of testdata/signature_vectors.json, made with
+// the NEAR JavaScript libraries so the codec is checked against what wallets
+// produce rather than against itself.
+type signatureVector struct {
+	Description       string `json:"description"`
+	PublicKey         string `json:"public_key"`
+	Message           string `json:"message"`
+	Signature         string `json:"signature"`
+	SignatureEncoding string `json:"signature_encoding"`
+	Standard          string `json:"standard"`
+	Nonce             string `json:"nonce"`
+	Recipient         string `json:"recipient"`
+	BorshHex          string `json:"borsh_hex"`
+	Sha256Hex         string `json:"sha256_hex"`
+	Valid             bool   `json:"valid"`
+}
+
+func loadSignatureVectors(t *testing.T) []signatureVector {
+	data, err := ioutil.ReadFile("testdata/signature_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file struct {
+		Vectors []signatureVector `json:"vectors"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Vectors) == 0 {
+		t.Fatal("no signature vectors")
+	}
+	return file.Vectors
+}
+
+func TestSignatureVectors(t *testing.T) {
+	for _, v := range loadSignatureVectors(t) {
+		t.Run(v.Description, func(t *testing.T) {
+			publicKey, err := ParsePublicKey(v.PublicKey)
+			if err != nil {
+				t.Fatalf("ParsePublicKey(%q): %v", v.PublicKey, err)
+			}
+
+			message := SignedMessage{Data: []byte(v.Message)}
+			if v.Standard == signatureStandardNEP413 {
+				message = nep413VectorHash(t, v)
+			}
+
+			signature, err := DecodeSignature(v.Signature, v.SignatureEncoding)
+			if err != nil {
+				t.Fatalf("DecodeSignature(%q, %q): %v", v.Signature, v.SignatureEncoding, err)
+			}
+
+			if got := publicKey.Verify(message, signature); got != v.Valid {
+				t.Errorf("Verify = %v, want %v", got, v.Valid)
+			}
+		})
+	}
+}
+
+// nep413VectorHash checks the borsh payload and its hash against the vector
+// and returns the hash, which is what the wallet signed.
+func nep413VectorHash(t *testing.T, v signatureVector) SignedMessage {
+	nonce, err := b64.StdEncoding.DecodeString(v.Nonce)
+	if err != nil || len(nonce) != 32 {
+		t.Fatalf("vector nonce %q is not 32 base64 encoded bytes", v.Nonce)
+	}
+
+	payload := nep413Payload{Message: v.Message, Recipient: v.Recipient}
+	copy(payload.Nonce[:], nonce)
+
+	if got := hex.EncodeToString(payload.borsh()); got != v.BorshHex {
+		t.Errorf("borsh = %s, want %s", got, v.BorshHex)
+	}
+	sum := sha256.Sum256(payload.borsh())
+	if got := hex.EncodeToString(sum[:]); got != v.Sha256Hex {
+		t.Errorf("sha256 = %s, want %s", got, v.Sha256Hex)
+	}
+	if got := hex.EncodeToString(payload.hash()); got != v.Sha256Hex {
+		t.Errorf("hash = %s, want %s", got, v.Sha256Hex)
+	}
+
+	dto := SignatureDto{Signature: v.Signature, SignatureEncoding: v.SignatureEncoding, Standard: v.Standard, Nonce: v.Nonce, Recipient: v.Recipient}
+	signed, _, err := nep413SignedBytes(dto, []byte(v.Message), v.Recipient)
+	if err != nil {
+		t.Fatalf("nep413SignedBytes: %v", err)
+	}
+	if got := hex.EncodeToString(signed.Data); got != v.Sha256Hex || !signed.Digest {
+		t.Errorf("nep413SignedBytes = %s digest %v, want the digest %s", got, signed.Digest, v.Sha256Hex)
+	}
+	return signed
+}
+
+func TestSecp256k1VerifyDigest(t *testing.T) {
+	privateKey, _ := hex.DecodeString("c9afa9d845ba75166b5c215767b1d6934e50c3db36e89b127b8a622b120f6721")
+	key := secp256k1.PrivKeyFromBytes(privateKey)
+	publicKey := PublicKey{Type: keyTypeSecp256k1, Data: key.PubKey().SerializeUncompressed()[1:]}
+
+	// a message that happens to be 32 bytes long is still hashed
+	message := []byte("0123456789abcdef0123456789abcdef")
+	digest := sha256.Sum256(message)
+
+	// compact signatures are v || r || s, NEAR orders them r || s || v
+	compact := ecdsa.SignCompact(key, digest[:], false)
+	signature := append(compact[1:], compact[0]-27)
+
+	tests := []struct {
+		name    string
+		message SignedMessage
+		want    bool
+	}{
+		{"message", SignedMessage{Data: message}, true},
+		{"digest of the message", SignedMessage{Data: digest[:], Digest: true}, true},
+		{"message taken for a digest", SignedMessage{Data: message, Digest: true}, false},
+		{"digest of the wrong size", SignedMessage{Data: digest[:31], Digest: true}, false},
+	}
+	for _, test := range tests {
+		if got := publicKey.Verify(test.message, signature); got != test.want {
+			t.Errorf("%s: Verify = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
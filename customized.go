@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// mergeIdSet is the set of merge_ids whose Feature rows change the tile
+// overlay output. Tiles that contain none of them are served as stored.
+type mergeIdSet struct {
+	mu       sync.RWMutex
+	mergeIds map[string]struct{}
+}
+
+func newMergeIdSet() *mergeIdSet {
+	return &mergeIdSet{mergeIds: make(map[string]struct{})}
+}
+
+func (set *mergeIdSet) has(mergeId string) bool {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	_, ok := set.mergeIds[mergeId]
+	return ok
+}
+
+func (set *mergeIdSet) set(mergeId string, present bool) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if present {
+		set.mergeIds[mergeId] = struct{}{}
+	} else {
+		delete(set.mergeIds, mergeId)
+	}
+}
+
+// affectsTile reports whether overlayFeature would write anything for the row.
+// With the opt-in view_bucket property every row does.
+func (fi FeatureInterceptor) affectsTile(feature *Feature) bool {
+	p := fi.tileProperties
+	return p["view_bucket"] ||
+		(p["name"] && feature.Name != "") ||
+		(p["color"] && feature.Color != "") ||
+		(p["customized"] && feature.IsCustomized()) ||
+		(p["has_description"] && feature.Description != "") ||
+		(p["has_media"] && feature.EmbeddedLink != "") ||
+		(p["has_vr"] && feature.LinkToVR != "") ||
+		(p["owner"] && feature.Owner != "")
+}
+
+// loadCustomizedFeatures fills the customized set from the Feature table.
+func (fi FeatureInterceptor) loadCustomizedFeatures() error {
+	batch := make([]Feature, 0)
+
+	return fi.db.Model(&Feature{}).
+		Select("id", "merge_id", "name", "description", "embedded_link", "color", "link_to_vr", "owner").
+		FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				if fi.affectsTile(&batch[i]) {
+					fi.customized.set(batch[i].MergeId, true)
+				}
+			}
+			return nil
+		}).Error
+}
+
+// tileHasCustomizedFeature scans the string values of a raw, possibly gzipped
+// tile for merge_ids in the customized set, without decoding any geometry.
+// A match on a value of some other key only costs a needless overlay.
+func (fi FeatureInterceptor) tileHasCustomizedFeature(tile []byte) (bool, error) {
+	if isGzipped(tile) {
+		var err error
+		if tile, err = gunzipBytes(tile); err != nil {
+			return false, err
+		}
+	}
+
+	found := false
+	err := walkProtobuf(tile, func(field uint64, layer []byte) error {
+		if field != 3 || found {
+			return nil
+		}
+		return walkProtobuf(layer, func(field uint64, value []byte) error {
+			if field != 4 || found {
+				return nil
+			}
+			return walkProtobuf(value, func(field uint64, s []byte) error {
+				if field == 1 && fi.customized.has(string(s)) {
+					found = true
+				}
+				return nil
+			})
+		})
+	})
+	return found, err
+}
+
+func isGzipped(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+var errMalformedProtobuf = errors.New("malformed protobuf message")
+
+// walkProtobuf calls fn for every length-delimited field of a protobuf message
+// and skips over all other wire types. In vector tiles, field 3 of the tile is
+// a layer, field 4 of a layer is a value and field 1 of a value is a string.
+func walkProtobuf(data []byte, fn func(field uint64, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errMalformedProtobuf
+		}
+		data = data[n:]
+
+		switch key & 0x7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errMalformedProtobuf
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errMalformedProtobuf
+			}
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errMalformedProtobuf
+			}
+			if err := fn(key>>3, data[n:n+int(length)]); err != nil {
+				return err
+			}
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errMalformedProtobuf
+			}
+			data = data[4:]
+		default:
+			return errMalformedProtobuf
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestWalkProtobuf(t *testing.T) {
+	message := []byte{
+		0x08, 0x96, 0x01, // field 1, varint 150
+		0x11, 1, 2, 3, 4, 5, 6, 7, 8, // field 2, fixed64
+		0x1a, 0x03, 'a', 'b', 'c', // field 3, bytes "abc"
+		0x25, 1, 2, 3, 4, // field 4, fixed32
+		0x2a, 0x00, // field 5, empty bytes
+	}
+
+	type field struct {
+		number uint64
+		value  string
+	}
+	got := make([]field, 0)
+	err := walkProtobuf(message, func(number uint64, value []byte) error {
+		got = append(got, field{number, string(value)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []field{{3, "abc"}, {5, ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWalkProtobufMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated key":          {0x80},
+		"overlong key":           {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"truncated varint value": {0x08, 0x80},
+		"overlong varint value":  {0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"truncated fixed64":      {0x09, 1, 2, 3},
+		"truncated fixed32":      {0x0d, 1, 2},
+		"length past the end":    {0x0a, 0x05, 'a', 'b'},
+		"huge length":            {0x0a, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 'a'},
+		"truncated length":       {0x0a},
+		"start group":            {0x0b},
+		"end group":              {0x0c},
+		"wire type 6":            {0x0e},
+		"wire type 7":            {0x0f},
+	}
+	for name, data := range tests {
+		err := walkProtobuf(data, func(uint64, []byte) error { return nil })
+		if err != errMalformedProtobuf {
+			t.Errorf("%s: got %v, want errMalformedProtobuf", name, err)
+		}
+	}
+}
+
+func TestTileHasCustomizedFeature(t *testing.T) {
+	fc := geojson.NewFeatureCollection()
+	building := geojson.NewFeature(orb.Point{10, 10})
+	building.Properties["merge_id"] = "way/100"
+	building.Properties["name"] = "way/300"
+	fc.Append(building)
+
+	layers := mvt.NewLayers(map[string]*geojson.FeatureCollection{"building": fc})
+	plain, err := mvt.Marshal(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipped, err := mvt.MarshalGzipped(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		customized string
+		want       bool
+	}{
+		{"way/100", true},
+		{"way/200", false},
+		// values of other keys match as well, which only costs an overlay
+		{"way/300", true},
+	}
+	for _, tile := range [][]byte{plain, gzipped} {
+		for _, tt := range tests {
+			fi := FeatureInterceptor{customized: newMergeIdSet()}
+			fi.customized.set(tt.customized, true)
+
+			got, err := fi.tileHasCustomizedFeature(tile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("customized %s, gzipped %v: got %v, want %v", tt.customized, isGzipped(tile), got, tt.want)
+			}
+		}
+	}
+
+	fi := FeatureInterceptor{customized: newMergeIdSet()}
+	if _, err := fi.tileHasCustomizedFeature(plain[:len(plain)-3]); err == nil {
+		t.Error("no error for a truncated tile")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runExport bakes the owner customizations into a new MBTiles file, for
+// clients that cannot call the tile API:
+//
+//	server export -out toronto-custom.mbtiles
+//
+// Every tile of the source tileset goes through the same overlay as GetTile.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		renderer = addRendererFlags(fs)
+		out      = fs.String("out", "", "path of the mbtiles file to create")
+		force    = fs.Bool("force", false, "replace the output file when it exists")
+	)
+	fs.Parse(args)
+
+	if *out == "" {
+		log.Fatal("export: -out is required")
+	}
+	if _, err := os.Stat(*out); err == nil && !*force {
+		log.Fatalf("export: %s exists, use -force to replace it", *out)
+	}
+
+	fi := renderer.openRenderer()
+
+	metadata, err := fi.tiles.Metadata()
+	if err != nil {
+		log.Fatalf("export: reading metadata: %v", err)
+	}
+
+	minZoom, maxZoom := fi.tiles.ZoomRange()
+	exportedAt := time.Now().UTC()
+	metadata["minzoom"] = fmt.Sprint(minZoom)
+	metadata["maxzoom"] = fmt.Sprint(maxZoom)
+	metadata["format"] = "pbf"
+	metadata["exported_at"] = exportedAt.Format(time.RFC3339)
+	metadata["overlay_properties"] = *renderer.tilePropertiesList
+	if fi.clusters != nil && fi.clusterMaxZoom >= int(minZoom) {
+		vectorLayers, _ := metadata["vector_layers"].([]interface{})
+		metadata["vector_layers"] = append(vectorLayers, clusterVectorLayer(minZoom, maxZoom, fi.clusterMaxZoom))
+	}
+
+	// build next to the destination and rename at the end, so a failed export
+	// never leaves a half written tileset behind
+	tmpPath := filepath.Join(filepath.Dir(*out), "."+filepath.Base(*out)+".tmp")
+	os.Remove(tmpPath)
+
+	writer, err := newMBTilesWriter(tmpPath)
+	if err != nil {
+		log.Fatalf("export: %v", err)
+	}
+
+	if err := writer.WriteMetadata(metadata); err != nil {
+		log.Fatalf("export: writing metadata: %v", err)
+	}
+
+	walk, total := walkTileset(fi.tiles, minZoom, maxZoom)
+	err = renderTiles(fi, walk, total, *renderer.workers, writer.WriteTile)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		log.Fatalf("export: %v", err)
+	}
+
+	if err := os.Chtimes(tmpPath, exportedAt, exportedAt); err != nil {
+		log.Printf("export: setting timestamp: %v", err)
+	}
+	if err := os.Rename(tmpPath, *out); err != nil {
+		log.Fatalf("export: %v", err)
+	}
+	log.Printf("exported %s", *out)
+}
+
+// mbtilesWriter creates an MBTiles file and batches tile inserts into
+// transactions. It is safe for concurrent use.
+type mbtilesWriter struct {
+	mu      sync.Mutex
+	db      *sql.DB
+	tx      *sql.Tx
+	pending int
+}
+
+const mbtilesWriterBatch = 1000
+
+func newMBTilesWriter(filename string) (*mbtilesWriter, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := []string{
+		"create table metadata (name text, value text)",
+		"create unique index name on metadata (name)",
+		"create table tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob)",
+		"create unique index tile_index on tiles (zoom_level, tile_column, tile_row)",
+	}
+	for _, statement := range schema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating mbtiles schema: %v", err)
+		}
+	}
+
+	return &mbtilesWriter{db: db}, nil
+}
+
+// WriteMetadata stores TileJSON metadata the way MBTiles expects it: plain
+// values as strings, and everything structured (vector_layers, tilestats)
+// inside the "json" entry.
+func (w *mbtilesWriter) WriteMetadata(metadata map[string]interface{}) error {
+	rows := make(map[string]string)
+	structured := make(map[string]interface{})
+
+	for name, value := range metadata {
+		switch v := value.(type) {
+		case string:
+			rows[name] = v
+		case float64:
+			rows[name] = fmt.Sprint(v)
+		case []interface{}:
+			if name == "bounds" || name == "center" {
+				parts := make([]string, 0, len(v))
+				for _, p := range v {
+					parts = append(parts, fmt.Sprint(p))
+				}
+				rows[name] = strings.Join(parts, ",")
+			} else {
+				structured[name] = v
+			}
+		default:
+			structured[name] = v
+		}
+	}
+
+	if len(structured) > 0 {
+		raw, err := json.Marshal(structured)
+		if err != nil {
+			return err
+		}
+		rows["json"] = string(raw)
+	}
+
+	for name, value := range rows {
+		if _, err := w.db.Exec("insert into metadata (name, value) values (?, ?)", name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *mbtilesWriter) WriteTile(job tileJob, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.tx == nil {
+		tx, err := w.db.Begin()
+		if err != nil {
+			return err
+		}
+		w.tx = tx
+	}
+
+	// flip y to the TMS scheme used by the tiles table
+	row := (uint64(1) << job.z) - 1 - job.y
+	_, err := w.tx.Exec("insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?)", job.z, job.x, row, data)
+	if err != nil {
+		return err
+	}
+
+	w.pending++
+	if w.pending >= mbtilesWriterBatch {
+		return w.commit()
+	}
+	return nil
+}
+
+func (w *mbtilesWriter) commit() error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx = nil
+	w.pending = 0
+	return err
+}
+
+func (w *mbtilesWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.commit(); err != nil {
+		w.db.Close()
+		return err
+	}
+	return w.db.Close()
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/planar"
+)
+
+// maxGeometryTiles caps the tiles read for a single feature; larger features
+// have to be requested at a lower zoom.
+const maxGeometryTiles = 64
+
+// tileLayersWGS84 decodes a stored tile into WGS84 coordinates, with every
+// geometry clipped to the tile itself so that neighbouring tiles never return
+// overlapping pieces of the same feature. It returns nil for missing tiles.
+func (fi FeatureInterceptor) tileLayersWGS84(z uint8, x uint64, y uint64) (mvt.Layers, error) {
+	data, err := fi.tiles.GetTileData(z, x, y)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	layers, err := mvt.UnmarshalGzipped(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding tile %d/%d/%d: %v", z, x, y, err)
+	}
+
+	for _, l := range layers {
+		l.Clip(orb.Bound{Max: orb.Point{float64(l.Extent), float64(l.Extent)}})
+		l.RemoveEmpty(0, 0)
+	}
+	layers.ProjectToWGS84(maptile.New(uint32(x), uint32(y), maptile.Zoom(z)))
+	return layers, nil
+}
+
+// forEachTileFeature calls fn with every feature of the tiles covering the
+// bound at zoom z, in WGS84.
+func (fi FeatureInterceptor) forEachTileFeature(bound orb.Bound, z uint8, fn func(layer string, f *geojson.Feature)) error {
+	minX, minY, maxX, maxY := tileRange(bound, z)
+	if (maxX-minX+1)*(maxY-minY+1) > maxGeometryTiles {
+		return errTooManyTiles
+	}
+
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			layers, err := fi.tileLayersWGS84(z, x, y)
+			if err != nil {
+				return err
+			}
+			for _, l := range layers {
+				for _, f := range l.Features {
+					fn(l.Name, f)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+var errTooManyTiles = fmt.Errorf("area covers more than %d tiles, use a lower zoom", maxGeometryTiles)
+
+// featureGeometry collects every piece carrying the merge_id from the tiles
+// covering the bound and stitches them into a single feature, with the tile
+// properties of the feature and its overlay applied. It returns nil when no
+// tile contains the feature.
+func (fi FeatureInterceptor) featureGeometry(mergeId string, bound orb.Bound, z uint8) (*geojson.Feature, error) {
+	pieces := make([]orb.Geometry, 0)
+	properties := geojson.Properties{}
+
+	err := fi.forEachTileFeature(bound, z, func(layer string, f *geojson.Feature) {
+		if id, _ := f.Properties["merge_id"].(string); id != mergeId {
+			return
+		}
+		pieces = append(pieces, f.Geometry)
+		for k, v := range f.Properties {
+			properties[k] = v
+		}
+		properties["tile_layer"] = layer
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pieces) == 0 {
+		return nil, nil
+	}
+
+	if fi.customized.has(mergeId) {
+		var feature Feature
+		if err := fi.db.First(&feature, "merge_id = ?", mergeId).Error; err == nil {
+			fi.overlayFeature(properties, &feature)
+		}
+	}
+
+	result := geojson.NewFeature(stitchGeometries(pieces))
+	result.Properties = properties
+	return result, nil
+}
+
+// geometryZoom reads the ?zoom= detail level, the tileset max zoom by default.
+func (fi FeatureInterceptor) geometryZoom(req *http.Request) (uint8, error) {
+	minZoom, maxZoom := fi.tiles.ZoomRange()
+
+	param := req.URL.Query().Get("zoom")
+	if param == "" {
+		return maxZoom, nil
+	}
+
+	z, err := strconv.ParseUint(param, 10, 8)
+	if err != nil || uint8(z) < minZoom || uint8(z) > maxZoom {
+		return 0, fmt.Errorf("zoom must be between %d and %d", minZoom, maxZoom)
+	}
+	return uint8(z), nil
+}
+
+// GetFeatureGeometry returns the outline of a feature as a GeoJSON Feature.
+func (fi FeatureInterceptor) GetFeatureGeometry(rw http.ResponseWriter, req *http.Request) {
+	mergeId := mux.Vars(req)["mergeId"]
+
+	z, err := fi.geometryZoom(req)
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	elasticElement, found := fi.s.getElasticElement(mergeId)
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	feature, err := fi.featureGeometry(mergeId, elementBound(elasticElement), z)
+	if err == errTooManyTiles {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("geometry of %s: %v", mergeId, err)
+		http.Error(rw, "could not read feature geometry", http.StatusInternalServerError)
+		return
+	}
+
+	if feature == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/geo+json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(feature)
+	rw.Write(body)
+}
+
+// stitchGeometries merges the per tile pieces of a feature. Line pieces that
+// meet at a tile border are joined back into one line; polygon pieces are
+// dissolved along the tile borders they share into the outline of the
+// feature.
+func stitchGeometries(pieces []orb.Geometry) orb.Geometry {
+	var points orb.MultiPoint
+	var lines orb.MultiLineString
+	var polygons orb.MultiPolygon
+
+	for _, piece := range pieces {
+		switch g := piece.(type) {
+		case orb.Point:
+			points = append(points, g)
+		case orb.MultiPoint:
+			points = append(points, g...)
+		case orb.LineString:
+			lines = append(lines, g)
+		case orb.MultiLineString:
+			lines = append(lines, g...)
+		case orb.Polygon:
+			polygons = append(polygons, g)
+		case orb.MultiPolygon:
+			polygons = append(polygons, g...)
+		}
+	}
+
+	if len(polygons) > 1 {
+		polygons = dissolvePolygons(polygons)
+	}
+
+	switch {
+	case len(polygons) == 1:
+		return polygons[0]
+	case len(polygons) > 1:
+		return polygons
+	case len(lines) > 0:
+		lines = joinLines(lines)
+		if len(lines) == 1 {
+			return lines[0]
+		}
+		return lines
+	case len(points) == 1:
+		return points[0]
+	default:
+		return points
+	}
+}
+
+// stitchTolerance is how far apart, in degrees, the rounded tile coordinates
+// of one point may be when it is read from two neighbouring tiles.
+const stitchTolerance = 1e-7
+
+// stitchKey snaps a point to the stitch tolerance grid.
+type stitchKey [2]int64
+
+func newStitchKey(p orb.Point) stitchKey {
+	return stitchKey{int64(math.Round(p[0] / stitchTolerance)), int64(math.Round(p[1] / stitchTolerance))}
+}
+
+type stitchEdge struct {
+	from, to stitchKey
+}
+
+// dissolvePolygons merges polygon pieces clipped from neighbouring tiles. The
+// rings are oriented so that the inside is on the left of every edge; a tile
+// border then shows up as the same segment in opposite directions in the
+// pieces on both sides of it, and dropping those pairs leaves the edges of the
+// real outline, which are chained back into rings. Border segments are split
+// at every vertex lying on them first, since the pieces on either side need
+// not end at the same points. The pieces are returned unchanged when the
+// edges do not form closed rings.
+func dissolvePolygons(polygons orb.MultiPolygon) orb.MultiPolygon {
+	points := make(map[stitchKey]orb.Point)
+	edges := make([]stitchEdge, 0)
+
+	for _, polygon := range polygons {
+		for i, r := range polygon {
+			r = r.Clone()
+			if (i == 0) != (r.Orientation() == orb.CCW) {
+				r.Reverse()
+			}
+			for j := 0; j+1 < len(r); j++ {
+				from, to := newStitchKey(r[j]), newStitchKey(r[j+1])
+				if from == to {
+					continue
+				}
+				points[from], points[to] = r[j], r[j+1]
+				edges = append(edges, stitchEdge{from, to})
+			}
+		}
+	}
+
+	edges = splitBorderEdges(edges)
+
+	// cancel every edge against one running the other way
+	count := make(map[stitchEdge]int)
+	for _, e := range edges {
+		count[e]++
+	}
+	outgoing := make(map[stitchKey][]stitchKey)
+	for _, e := range edges {
+		twin := stitchEdge{e.to, e.from}
+		if count[twin] > 0 && count[e] > 0 {
+			count[twin]--
+			count[e]--
+			continue
+		}
+		if count[e] > 0 {
+			count[e]--
+			outgoing[e.from] = append(outgoing[e.from], e.to)
+		}
+	}
+
+	rings := make([]orb.Ring, 0)
+	for _, e := range edges {
+		for len(outgoing[e.from]) > 0 {
+			start := e.from
+			keys := []stitchKey{start}
+			for at := start; ; {
+				next := outgoing[at]
+				if len(next) == 0 {
+					return polygons
+				}
+				outgoing[at] = next[1:]
+				at = next[0]
+				if at == start {
+					break
+				}
+				keys = append(keys, at)
+			}
+
+			// drop the vertices left in the middle of straight border runs
+			ring := make(orb.Ring, 0, len(keys)+1)
+			for i, k := range keys {
+				prev, next := keys[(i+len(keys)-1)%len(keys)], keys[(i+1)%len(keys)]
+				if (prev[0] == k[0] && k[0] == next[0]) || (prev[1] == k[1] && k[1] == next[1]) {
+					continue
+				}
+				ring = append(ring, points[k])
+			}
+			if len(ring) > 0 {
+				ring = append(ring, ring[0])
+			}
+			rings = append(rings, ring)
+		}
+	}
+
+	result := make(orb.MultiPolygon, 0)
+	holes := make([]orb.Ring, 0)
+	for _, r := range rings {
+		if len(r) < 4 {
+			continue
+		}
+		if r.Orientation() == orb.CCW {
+			result = append(result, orb.Polygon{r})
+		} else {
+			holes = append(holes, r)
+		}
+	}
+	if len(result) == 0 {
+		return polygons
+	}
+
+	// each hole belongs to the smallest outline around it
+	for _, hole := range holes {
+		best := -1
+		for i, polygon := range result {
+			if !planar.RingContains(polygon[0], hole[0]) {
+				continue
+			}
+			if best < 0 || planar.Area(polygon[0]) < planar.Area(result[best][0]) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			result[best] = append(result[best], hole)
+		}
+	}
+	return result
+}
+
+// splitBorderEdges splits the horizontal and vertical edges, which include all
+// tile border segments, at the end points of the others lying inside them.
+func splitBorderEdges(edges []stitchEdge) []stitchEdge {
+	vertices := make([]stitchKey, 0)
+	for _, e := range edges {
+		if e.from[0] == e.to[0] || e.from[1] == e.to[1] {
+			vertices = append(vertices, e.from, e.to)
+		}
+	}
+
+	result := make([]stitchEdge, 0, len(edges))
+	for _, e := range edges {
+		axis := -1
+		if e.from[0] == e.to[0] {
+			axis = 1
+		} else if e.from[1] == e.to[1] {
+			axis = 0
+		}
+		if axis < 0 {
+			result = append(result, e)
+			continue
+		}
+
+		lo, hi := e.from[axis], e.to[axis]
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		cuts := make([]int64, 0)
+		for _, v := range vertices {
+			if v[1-axis] == e.from[1-axis] && v[axis] > lo && v[axis] < hi {
+				cuts = append(cuts, v[axis])
+			}
+		}
+		if len(cuts) == 0 {
+			result = append(result, e)
+			continue
+		}
+
+		sort.Slice(cuts, func(i, j int) bool { return cuts[i] < cuts[j] })
+		if e.from[axis] > e.to[axis] {
+			for i, j := 0, len(cuts)-1; i < j; i, j = i+1, j-1 {
+				cuts[i], cuts[j] = cuts[j], cuts[i]
+			}
+		}
+		from := e.from
+		for _, c := range cuts {
+			to := from
+			to[axis] = c
+			if to != from {
+				result = append(result, stitchEdge{from, to})
+			}
+			from = to
+		}
+		result = append(result, stitchEdge{from, e.to})
+	}
+	return result
+}
+
+// joinLines concatenates lines whose end points meet, within a small
+// tolerance for the rounding of tile coordinates.
+func joinLines(lines orb.MultiLineString) orb.MultiLineString {
+	near := func(a, b orb.Point) bool {
+		return math.Abs(a[0]-b[0]) < stitchTolerance && math.Abs(a[1]-b[1]) < stitchTolerance
+	}
+
+	result := make(orb.MultiLineString, 0, len(lines))
+	for _, line := range lines {
+		if len(line) > 0 {
+			result = append(result, line.Clone())
+		}
+	}
+
+	for joined := true; joined; {
+		joined = false
+		for i := 0; i < len(result) && !joined; i++ {
+			for j := 0; j < len(result) && !joined; j++ {
+				if i == j {
+					continue
+				}
+				a, b := result[i], result[j]
+				if near(a[len(a)-1], b[0]) {
+					result[i] = append(a, b[1:]...)
+				} else if near(a[len(a)-1], b[len(b)-1]) {
+					reversed := b.Clone()
+					reversed.Reverse()
+					result[i] = append(a, reversed[1:]...)
+				} else {
+					continue
+				}
+				result = append(result[:j], result[j+1:]...)
+				joined = true
+			}
+		}
+	}
+	return result
+}
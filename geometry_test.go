@@ -0,0 +1,308 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/planar"
+)
+
+// testTile is a zoom 14 tile in Toronto; the test shapes are placed around its
+// top left corner, so that they straddle it and its neighbours.
+var testTile = maptile.New(4578, 5980, 14)
+
+// cornerSquare is the square of the given half width, in tile widths, around
+// the point offset from the top left corner of testTile. The exterior ring is
+// clockwise in WGS84, as rings are in vector tiles once projected.
+func cornerSquare(dx, dy, half float64) orb.Ring {
+	bound := testTile.Bound()
+	w, h := bound.Max[0]-bound.Min[0], bound.Max[1]-bound.Min[1]
+	cx, cy := bound.Min[0]+dx*w, bound.Max[1]-dy*h
+	return orb.Ring{
+		{cx - half*w, cy - half*h},
+		{cx - half*w, cy + half*h},
+		{cx + half*w, cy + half*h},
+		{cx + half*w, cy - half*h},
+		{cx - half*w, cy - half*h},
+	}
+}
+
+// tilePieces cuts the geometry into the pieces that the tiles at zoom 14
+// covering it return, the way tileLayersWGS84 reads them.
+func tilePieces(t *testing.T, g orb.Geometry) []orb.Geometry {
+	pieces := make([]orb.Geometry, 0)
+	minX, minY, maxX, maxY := tileRange(g.Bound(), 14)
+
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			tile := maptile.New(uint32(x), uint32(y), 14)
+			fc := geojson.NewFeatureCollection()
+			fc.Append(geojson.NewFeature(orb.Clone(g)))
+			layers := mvt.NewLayers(map[string]*geojson.FeatureCollection{"test": fc})
+			layers.ProjectToTile(tile)
+
+			data, err := mvt.Marshal(layers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers, err = mvt.Unmarshal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, l := range layers {
+				l.Clip(orb.Bound{Max: orb.Point{float64(l.Extent), float64(l.Extent)}})
+				l.RemoveEmpty(0, 0)
+			}
+			layers.ProjectToWGS84(tile)
+			for _, l := range layers {
+				for _, f := range l.Features {
+					pieces = append(pieces, f.Geometry)
+				}
+			}
+		}
+	}
+	return pieces
+}
+
+func TestDissolvePolygons(t *testing.T) {
+	reversed := func(r orb.Ring) orb.Ring {
+		r = r.Clone()
+		r.Reverse()
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		input    orb.Geometry
+		pieces   int
+		polygons int
+		rings    []int
+	}{
+		{
+			name:     "square across two tiles",
+			input:    orb.Polygon{cornerSquare(0, 0.5, 0.2)},
+			pieces:   2,
+			polygons: 1,
+			rings:    []int{5},
+		},
+		{
+			name:     "square across four tiles",
+			input:    orb.Polygon{cornerSquare(0, 0, 0.2)},
+			pieces:   4,
+			polygons: 1,
+			rings:    []int{5},
+		},
+		{
+			name:     "square with a hole across four tiles",
+			input:    orb.Polygon{cornerSquare(0, 0, 0.3), reversed(cornerSquare(0, 0, 0.1))},
+			pieces:   4,
+			polygons: 1,
+			rings:    []int{5, 5},
+		},
+		{
+			name:     "hole on one side of the border",
+			input:    orb.Polygon{cornerSquare(0, 0.5, 0.3), reversed(cornerSquare(0.15, 0.5, 0.1))},
+			pieces:   2,
+			polygons: 1,
+			rings:    []int{5, 5},
+		},
+		{
+			name: "separate squares in neighbouring tiles",
+			input: orb.MultiPolygon{
+				{cornerSquare(-0.5, 0.5, 0.2)},
+				{cornerSquare(0.5, 0.5, 0.2)},
+			},
+			pieces:   2,
+			polygons: 2,
+			rings:    []int{5},
+		},
+	}
+
+	for _, test := range tests {
+		pieces := tilePieces(t, test.input)
+		polygons := make(orb.MultiPolygon, 0)
+		for _, piece := range pieces {
+			switch g := piece.(type) {
+			case orb.Polygon:
+				polygons = append(polygons, g)
+			case orb.MultiPolygon:
+				polygons = append(polygons, g...)
+			}
+		}
+		if len(polygons) != test.pieces {
+			t.Errorf("%s: %d pieces, want %d", test.name, len(polygons), test.pieces)
+			continue
+		}
+
+		result := dissolvePolygons(polygons)
+		if len(result) != test.polygons {
+			t.Errorf("%s: %d polygons, want %d", test.name, len(result), test.polygons)
+			continue
+		}
+
+		area := 0.0
+		for _, polygon := range result {
+			if len(polygon) != len(test.rings) {
+				t.Errorf("%s: %d rings, want %d", test.name, len(polygon), len(test.rings))
+				continue
+			}
+			for i, r := range polygon {
+				if len(r) != test.rings[i] {
+					t.Errorf("%s: ring %d has %d points, want %d", test.name, i, len(r), test.rings[i])
+				}
+				if want := i == 0; (r.Orientation() == orb.CCW) != want {
+					t.Errorf("%s: ring %d has the wrong orientation", test.name, i)
+				}
+			}
+			area += planar.Area(polygon)
+		}
+
+		// the tiles round to 1/4096 of their width
+		want := planar.Area(test.input)
+		if math.Abs(area-want)/want > 0.01 {
+			t.Errorf("%s: area %g, want %g", test.name, area, want)
+		}
+	}
+}
+
+func TestDissolvePolygonsKeepsOpenPieces(t *testing.T) {
+	// a lone border segment without its twin leaves a dead end
+	polygons := orb.MultiPolygon{
+		{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}},
+		{{{2, 0}, {3, 0}, {3, 1}, {2, 0}}},
+	}
+	result := dissolvePolygons(polygons)
+	if len(result) != 2 {
+		t.Errorf("got %d polygons, want the 2 input triangles", len(result))
+	}
+}
+
+func TestSplitBorderEdges(t *testing.T) {
+	key := func(x, y int64) stitchKey { return stitchKey{x, y} }
+
+	tests := []struct {
+		name  string
+		edges []stitchEdge
+		want  []stitchEdge
+	}{
+		{
+			name: "vertical edge split at the vertex of its twin side",
+			edges: []stitchEdge{
+				{key(0, 0), key(0, 10)},
+				{key(0, 4), key(-3, 4)},
+			},
+			want: []stitchEdge{
+				{key(0, 0), key(0, 4)},
+				{key(0, 4), key(0, 10)},
+				{key(0, 4), key(-3, 4)},
+			},
+		},
+		{
+			name: "reversed horizontal edge split twice, in order",
+			edges: []stitchEdge{
+				{key(10, 5), key(0, 5)},
+				{key(2, 5), key(2, 9)},
+				{key(7, 5), key(7, 9)},
+			},
+			want: []stitchEdge{
+				{key(10, 5), key(7, 5)},
+				{key(7, 5), key(2, 5)},
+				{key(2, 5), key(0, 5)},
+				{key(2, 5), key(2, 9)},
+				{key(7, 5), key(7, 9)},
+			},
+		},
+		{
+			name: "vertices off the edge line and at its ends",
+			edges: []stitchEdge{
+				{key(0, 0), key(0, 10)},
+				{key(1, 5), key(1, 6)},
+				{key(0, 10), key(0, 12)},
+			},
+			want: []stitchEdge{
+				{key(0, 0), key(0, 10)},
+				{key(1, 5), key(1, 6)},
+				{key(0, 10), key(0, 12)},
+			},
+		},
+		{
+			name: "diagonal edges are never split",
+			edges: []stitchEdge{
+				{key(0, 0), key(10, 10)},
+				{key(5, 5), key(5, 8)},
+			},
+			want: []stitchEdge{
+				{key(0, 0), key(10, 10)},
+				{key(5, 5), key(5, 8)},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := splitBorderEdges(test.edges)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestJoinLines(t *testing.T) {
+	bound := testTile.Bound()
+	y := (bound.Min[1] + bound.Max[1]) / 2
+	w := bound.Max[0] - bound.Min[0]
+
+	across := orb.LineString{{bound.Min[0] - w/3, y}, {bound.Min[0] + w/3, y + w/10}}
+	pieces := tilePieces(t, across)
+	if len(pieces) != 2 {
+		t.Fatalf("line crosses %d tiles, want 2", len(pieces))
+	}
+
+	tests := []struct {
+		name  string
+		lines orb.MultiLineString
+		want  int
+	}{
+		{"line across a tile border", orb.MultiLineString{pieces[0].(orb.LineString), pieces[1].(orb.LineString)}, 1},
+		{"pieces in reverse order", orb.MultiLineString{pieces[1].(orb.LineString), pieces[0].(orb.LineString)}, 1},
+		{"ends within the tolerance", orb.MultiLineString{{{0, 0}, {1, 1}}, {{1 + stitchTolerance/2, 1}, {2, 2}}}, 1},
+		{"ends beyond the tolerance", orb.MultiLineString{{{0, 0}, {1, 1}}, {{1 + 2*stitchTolerance, 1}, {2, 2}}}, 2},
+		{"lines meeting end to end", orb.MultiLineString{{{0, 0}, {1, 1}}, {{2, 2}, {1, 1}}}, 1},
+		{"empty lines are dropped", orb.MultiLineString{{}, {{0, 0}, {1, 1}}}, 1},
+	}
+
+	for _, test := range tests {
+		got := joinLines(test.lines)
+		if len(got) != test.want {
+			t.Errorf("%s: %d lines, want %d", test.name, len(got), test.want)
+		}
+	}
+
+	joined := joinLines(orb.MultiLineString{pieces[1].(orb.LineString), pieces[0].(orb.LineString)})[0]
+	start, end := joined[0], joined[len(joined)-1]
+	if math.Abs(math.Abs(end[0]-start[0])-2*w/3) > w/1000 {
+		t.Errorf("joined line spans %g degrees, want %g", math.Abs(end[0]-start[0]), 2*w/3)
+	}
+}
+
+func TestNewStitchKey(t *testing.T) {
+	p := orb.Point{-79.40918, 43.65107}
+
+	if newStitchKey(p) != newStitchKey(orb.Point{p[0] + stitchTolerance/3, p[1] - stitchTolerance/3}) {
+		t.Error("points within a third of the tolerance get different keys")
+	}
+	if newStitchKey(p) == newStitchKey(orb.Point{p[0] + 2*stitchTolerance, p[1]}) {
+		t.Error("points two tolerances apart share a key")
+	}
+}
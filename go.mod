@@ -3,10 +3,16 @@ module server
 go 1.17
 
 require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1
+	github.com/dhconnelly/rtreego v1.2.0
 	github.com/go-playground/validator v9.31.0+incompatible
 	github.com/mattn/go-sqlite3 v1.14.11
+	github.com/mr-tron/base58 v1.2.0
 	github.com/olivere/elastic/v7 v7.0.31
 	github.com/paulmach/orb v0.4.0
+	github.com/rs/cors v1.8.2
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/image v0.0.0-20220302094943-723b81ca9867
 	gorm.io/driver/postgres v1.2.3
 	gorm.io/gorm v1.22.5
 )
@@ -26,10 +32,7 @@ require (
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.4 // indirect
 	github.com/leodido/go-urn v1.2.1 // indirect
-	github.com/mr-tron/base58 v1.2.0 // indirect
 	github.com/paulmach/protoscan v0.2.1-0.20210522164731-4e53c6875432 // indirect
-	github.com/rs/cors v1.8.2 // indirect
-	golang.org/x/crypto v0.0.0-20220214200702-86341886e292 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 )
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/olivere/elastic/v7"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// heatLayerName is the only layer of the heat tiles.
+	heatLayerName = "heat"
+	// heatGrid is the number of density cells along each side of a tile.
+	heatGrid = 64
+)
+
+type heatPoint struct {
+	point orb.Point
+	views uint64
+}
+
+// HeatMap is a snapshot of the viewed features, each at the center of its
+// bounding box and weighted by its view count. It is rebuilt on a schedule
+// rather than on every view, so tiles can be cached for the interval.
+type HeatMap struct {
+	mu       sync.RWMutex
+	points   []heatPoint // sorted by longitude
+	maxViews uint64
+	builtAt  time.Time
+}
+
+// Build reads the view counts mirrored into the Feature table and swaps the
+// snapshot in. Until the first build finishes, the handler answers 503.
+func (heat *HeatMap) Build(db *gorm.DB, s *SearchServer) error {
+	start := time.Now()
+	points := make([]heatPoint, 0)
+	var maxViews uint64
+
+	batch := make([]Feature, 0)
+	err := db.Model(&Feature{}).
+		Select("id", "merge_id", "views", "lon", "lat").
+		Where("views > 0").
+		FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+			for i := range batch {
+				feature := &batch[i]
+				if err := fillFeatureCenter(db, s, feature); err != nil {
+					return err
+				}
+				if feature.Lon == 0 && feature.Lat == 0 {
+					continue
+				}
+
+				points = append(points, heatPoint{point: orb.Point{feature.Lon, feature.Lat}, views: feature.Views})
+				if feature.Views > maxViews {
+					maxViews = feature.Views
+				}
+			}
+			return nil
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].point[0] < points[j].point[0] })
+
+	heat.mu.Lock()
+	heat.points = points
+	heat.maxViews = maxViews
+	heat.builtAt = time.Now()
+	heat.mu.Unlock()
+
+	log.Printf("heat map: %d viewed features in %s", len(points), time.Since(start))
+	return nil
+}
+
+// viewBackfillMigration names the backfill in the DataMigration table.
+const viewBackfillMigration = "backfill_views"
+
+// backfillViews copies the view counts of the search index into the Feature
+// table, which only mirrors the views counted since countView started doing
+// so. It runs once, before the first heat map build, and is recorded as done
+// when it finished. Only the views column is written: the rows it creates
+// carry no customization, and the heat map build fills in their centers.
+func backfillViews(db *gorm.DB, s *SearchServer) error {
+	var done int64
+	if err := db.Model(&DataMigration{}).Where("name = ?", viewBackfillMigration).Count(&done).Error; err != nil {
+		return fmt.Errorf("reading migrations: %v", err)
+	}
+	if done > 0 {
+		return nil
+	}
+
+	start := time.Now()
+	ctx := context.Background()
+	scroll := s.client.Scroll(s.index).
+		Query(elastic.NewRangeQuery("view").Gt(0)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("merge_id", "view")).
+		Size(1000)
+	defer scroll.Clear(ctx)
+
+	count := 0
+	for {
+		result, err := scroll.Do(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("scrolling search index: %v", err)
+		}
+
+		features := make([]Feature, 0, len(result.Hits.Hits))
+		for _, hit := range result.Hits.Hits {
+			var element IndexableElement
+			if err := json.Unmarshal(hit.Source, &element); err != nil || element.Merge_id == "" {
+				continue
+			}
+			features = append(features, Feature{MergeId: element.Merge_id, Views: element.View})
+		}
+		if len(features) == 0 {
+			continue
+		}
+
+		// countView may have stored a newer count in the meantime
+		err = db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "merge_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"views"}),
+			Where:     clause.Where{Exprs: []clause.Expression{gorm.Expr("features.views < excluded.views")}},
+		}).Create(&features).Error
+		if err != nil {
+			return fmt.Errorf("storing view counts: %v", err)
+		}
+		count += len(features)
+	}
+
+	if err := db.Create(&DataMigration{Name: viewBackfillMigration}).Error; err != nil {
+		return fmt.Errorf("recording migration: %v", err)
+	}
+	log.Printf("view counts: %d features backfilled from the search index in %s", count, time.Since(start))
+	return nil
+}
+
+// Schedule rebuilds the snapshot every interval, starting right away.
+func (heat *HeatMap) Schedule(db *gorm.DB, s *SearchServer, interval time.Duration) {
+	for {
+		if err := heat.Build(db, s); err != nil {
+			log.Printf("building heat map: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (heat *HeatMap) ready() bool {
+	heat.mu.RLock()
+	defer heat.mu.RUnlock()
+
+	return !heat.builtAt.IsZero()
+}
+
+// tileLayer sums the views of the points inside the tile on a grid of
+// heatGrid cells. Each cell carries the summed views and a weight between 0
+// and 1 on a log scale of the most viewed feature, which suits the
+// heatmap-weight of MapLibre styles. It returns nil when the tile is empty.
+func (heat *HeatMap) tileLayer(z uint8, x uint64, y uint64) *mvt.Layer {
+	tile := maptile.New(uint32(x), uint32(y), maptile.Zoom(z))
+	bound := tile.Bound()
+
+	cells := make(map[[2]int]uint64)
+	heat.mu.RLock()
+	maxViews := heat.maxViews
+	first := sort.Search(len(heat.points), func(i int) bool { return heat.points[i].point[0] >= bound.Min[0] })
+	for _, p := range heat.points[first:] {
+		if p.point[0] > bound.Max[0] {
+			break
+		}
+		if !bound.Contains(p.point) {
+			continue
+		}
+		f := maptile.Fraction(p.point, maptile.Zoom(z))
+		cell := [2]int{
+			int(math.Min(heatGrid-1, (f[0]-float64(x))*heatGrid)),
+			int(math.Min(heatGrid-1, (f[1]-float64(y))*heatGrid)),
+		}
+		cells[cell] += p.views
+	}
+	heat.mu.RUnlock()
+
+	if len(cells) == 0 {
+		return nil
+	}
+
+	keys := make([][2]int, 0, len(cells))
+	for cell := range cells {
+		keys = append(keys, cell)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][1] < keys[j][1] || (keys[i][1] == keys[j][1] && keys[i][0] < keys[j][0])
+	})
+
+	fc := geojson.NewFeatureCollection()
+	for _, cell := range keys {
+		views := cells[cell]
+		// cell centers, already in tile coordinates
+		f := geojson.NewFeature(orb.Point{
+			(float64(cell[0]) + 0.5) / heatGrid * mvt.DefaultExtent,
+			(float64(cell[1]) + 0.5) / heatGrid * mvt.DefaultExtent,
+		})
+		f.Properties["views"] = views
+		f.Properties["weight"] = math.Min(1, math.Log1p(float64(views))/math.Log1p(float64(maxViews)))
+		fc.Append(f)
+	}
+
+	return mvt.NewLayer(heatLayerName, fc)
+}
+
+// GetHeatTile serves /tiles/heat/{z}/{x}/{y} as gzipped vector tiles with a
+// single point layer of view density.
+func (fi FeatureInterceptor) GetHeatTile(rw http.ResponseWriter, req *http.Request) {
+	if fi.heat == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !fi.heat.ready() {
+		http.Error(rw, "heat map is being built", http.StatusServiceUnavailable)
+		return
+	}
+
+	z, x, y, err := fi.parseTileCoordinates(mux.Vars(req))
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	layer := fi.heat.tileLayer(z, x, y)
+	if layer == nil {
+		rw.WriteHeader(fi.missingTileStatus)
+		return
+	}
+
+	data, err := mvt.MarshalGzipped(mvt.Layers{layer})
+	if err != nil {
+		log.Printf("heat tile %d/%d/%d: %v", z, x, y, err)
+		http.Error(rw, "could not render tile", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	rw.Header().Set("Content-Encoding", "gzip")
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(fi.heatInterval.Seconds())))
+	rw.Write(data)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	b58 "github.com/mr-tron/base58/base58"
+)
+
+// signingKeysEnv holds the keystore JSON when it is not read from a file.
+const signingKeysEnv = "SHIZO_SIGNING_KEYS"
+
+var errNoSigningKey = errors.New("no signing key configured")
+
+// SigningKey is a master key that signs vouchers.
+type SigningKey struct {
+	ID         string
+	PrivateKey ed25519.PrivateKey
+}
+
+// Keystore hands out the master keys. The active key signs, and every key it
+// knows, including retired ones that only have a public key, keeps verifying
+// so signatures stay valid while keys are rotated. Implementations backed by
+// a KMS or vault plug in here.
+type Keystore interface {
+	// SigningKey returns the key new signatures are made with.
+	SigningKey() (SigningKey, error)
+	// PublicKey returns the public key with the ID, active or retired.
+	PublicKey(id string) (PublicKey, bool)
+	// KeyIDs lists every key that verifies.
+	KeyIDs() []string
+}
+
+// staticKeystore is a Keystore read from JSON once at startup:
+//
+//	{
+//	  "active": "2024-06",
+//	  "keys": [
+//	    {"id": "2024-06", "private_key": "ed25519:<base58>"},
+//	    {"id": "2023-11", "public_key": "ed25519:<base58>"}
+//	  ]
+//	}
+//
+// Retired keys can keep their private key or only list the public key.
+type staticKeystore struct {
+	active     string
+	ids        []string
+	private    map[string]ed25519.PrivateKey
+	publicKeys map[string]PublicKey
+}
+
+type keystoreFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		ID         string `json:"id"`
+		PrivateKey string `json:"private_key"`
+		PublicKey  string `json:"public_key"`
+	} `json:"keys"`
+}
+
+func parseKeystore(data []byte) (*staticKeystore, error) {
+	var file keystoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing keystore: %v", err)
+	}
+
+	keystore := &staticKeystore{
+		active:     file.Active,
+		private:    make(map[string]ed25519.PrivateKey),
+		publicKeys: make(map[string]PublicKey),
+	}
+
+	for _, key := range file.Keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") {
+			return nil, fmt.Errorf("key id %q must be non-empty and must not contain ':'", key.ID)
+		}
+		if _, ok := keystore.publicKeys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+
+		switch {
+		case key.PrivateKey != "":
+			privateKey, err := ParsePrivateKey(key.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", key.ID, err)
+			}
+			keystore.private[key.ID] = privateKey
+			keystore.publicKeys[key.ID] = PublicKey{Type: keyTypeED25519, Data: privateKey.Public().(ed25519.PublicKey)}
+		case key.PublicKey != "":
+			publicKey, err := ParsePublicKey(key.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %v", key.ID, err)
+			}
+			keystore.publicKeys[key.ID] = publicKey
+		default:
+			return nil, fmt.Errorf("key %q has neither a private nor a public key", key.ID)
+		}
+		keystore.ids = append(keystore.ids, key.ID)
+	}
+
+	if _, ok := keystore.private[file.Active]; !ok {
+		return nil, fmt.Errorf("active key %q has no private key", file.Active)
+	}
+	return keystore, nil
+}
+
+func (keystore *staticKeystore) SigningKey() (SigningKey, error) {
+	return SigningKey{ID: keystore.active, PrivateKey: keystore.private[keystore.active]}, nil
+}
+
+func (keystore *staticKeystore) PublicKey(id string) (PublicKey, bool) {
+	key, ok := keystore.publicKeys[id]
+	return key, ok
+}
+
+func (keystore *staticKeystore) KeyIDs() []string {
+	return keystore.ids
+}
+
+// loadKeystore reads the keystore from the file, or from the SHIZO_SIGNING_KEYS
+// environment variable when no file is given. Keys never come from flags, so
+// they stay out of process listings and shell history. It returns nil when
+// neither is set.
+func loadKeystore(path string) (Keystore, error) {
+	var data []byte
+	switch {
+	case path != "":
+		var err error
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("reading keystore: %v", err)
+		}
+	case os.Getenv(signingKeysEnv) != "":
+		data = []byte(os.Getenv(signingKeysEnv))
+	default:
+		return nil, nil
+	}
+
+	keystore, err := parseKeystore(data)
+	if err != nil {
+		return nil, err
+	}
+	return keystore, nil
+}
+
+// ParsePrivateKey reads a NEAR "ed25519:<base58>" private key, the 64 byte
+// seed and public key pair, or a bare 32 byte seed. The prefix is optional.
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		if s[:i] != keyTypeED25519 {
+			return nil, errUnknownKeyType
+		}
+		s = s[i+1:]
+	}
+
+	data, err := b58.Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("decoding private key: %v", err)
+	}
+
+	switch len(data) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		privateKey := ed25519.NewKeyFromSeed(data[:ed25519.SeedSize])
+		if string(privateKey[ed25519.SeedSize:]) != string(data[ed25519.SeedSize:]) {
+			return nil, errors.New("private key does not match its public key")
+		}
+		return privateKey, nil
+	default:
+		return nil, fmt.Errorf("private key must be %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(data))
+	}
+}
+
+// signingKey returns the active key of the keystore.
+func (featureSigner *FeatureSigner) signingKey() (SigningKey, error) {
+	if featureSigner.keys == nil {
+		return SigningKey{}, errNoSigningKey
+	}
+	return featureSigner.keys.SigningKey()
+}
+
+// verify checks a signature against the key with the ID, including retired
+// keys.
+func (featureSigner *FeatureSigner) verify(keyId string, message SignedMessage, signature []byte) bool {
+	if featureSigner.keys == nil {
+		return false
+	}
+
+	key, ok := featureSigner.keys.PublicKey(keyId)
+	return ok && key.Verify(message, signature)
+}
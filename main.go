@@ -7,6 +7,8 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"os"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -22,10 +24,8 @@ import (
 
 	"github.com/go-playground/validator"
 	"github.com/gorilla/mux"
-	b58 "github.com/mr-tron/base58"
 	"github.com/paulmach/orb/encoding/mvt"
 	"github.com/rs/cors"
-	"golang.org/x/crypto/ed25519"
 )
 
 func getClient(url string, sniff bool) *elastic.Client {
@@ -62,14 +62,30 @@ type SearchServer struct {
 
 type FeatureSigner struct {
 	s *SearchServer
-	privateKey []byte
+	db *gorm.DB
+	nearInteractor *NearInteractor
+	keys Keystore
+	rules MintRules
 }
 
 type FeatureInterceptor struct {
 	db       *gorm.DB
 	s        *SearchServer
-	mbTileDB *MBTileDB
+	tiles    TileSource
 	nearInteractor *NearInteractor
+	missingTileStatus int
+	glyphsURL      string
+	tileProperties map[string]bool
+	customized     *mergeIdSet
+	tileCache      *TileCache
+	viewInvalidations *pendingInvalidations
+	tileSchema     tileSchema
+	overzoom       uint8
+	sessionTTL     time.Duration
+	clusters       *ClusterIndex
+	clusterMaxZoom int
+	heat           *HeatMap
+	heatInterval   time.Duration
 }
 
 type IndexableElement struct {
@@ -94,6 +110,16 @@ type ExtendedFeatureDto struct {
 
 type SignatureDto struct {
 	Signature	string 		`json:"signature" validate:"required"`
+	// SignatureEncoding is base58 (the default, optionally "ed25519:" prefixed), base64 or hex
+	SignatureEncoding	string	`json:"signature_encoding,omitempty"`
+	Nonce		string		`json:"nonce,omitempty"`
+	Expires		int64		`json:"expires,omitempty"`
+	// Standard is empty for a signature over the signed message itself and
+	// "nep413" for a wallet signMessage signature, which also sends the
+	// recipient and callback URL it signed
+	Standard	string		`json:"standard,omitempty"`
+	Recipient	string		`json:"recipient,omitempty"`
+	CallbackUrl	*string		`json:"callback_url,omitempty"`
 }
 
 type FeatureList struct {
@@ -200,17 +226,24 @@ func (s *SearchServer) handleGet(w http.ResponseWriter, req *http.Request) {
 
 var validate *validator.Validate
 
+// featureColorPalette is the fixed set of colors owners can pick for a feature.
+var featureColorPalette = []string{
+	"#AAE0FA", "#57C8FF", "#189EFF",
+	"#0047FF", "#561BFF", "#AD5AFF",
+	"#FFCA08", "#F7941D", "#F25822",
+	"#D8DF20", "#71BF45", "#00A65E",
+	"#F5F5F5", "#BDBDBD", "#808080",
+	"#606060", "#303030", "#101010",
+}
+
 
 
 func UserStructLevelValidation(sl validator.StructLevel) {
     embeddedLinkRegexPatterns := []string{"^(?:https?:\\/\\/)?(?:m\\.|www\\.)?(?:youtu\\.be\\/|youtube\\.com\\/(?:embed\\/|v\\/|watch\\?v=|watch\\?.+&v=))((\\w|-){11})(?:\\S+)?$"}
-	validColors := map[string]bool{"#AAE0FA": true, "#57C8FF": true, "#189EFF": true,
-								   "#0047FF": true, "#561BFF": true, "#AD5AFF": true,
-								   "#FFCA08": true, "#F7941D": true, "#F25822": true,
-								   "#D8DF20": true, "#71BF45": true, "#00A65E": true,
-								   "#F5F5F5": true, "#BDBDBD": true, "#808080": true,
-								   "#606060": true, "#303030": true, "#101010": true,
-								}
+	validColors := make(map[string]bool)
+	for _, color := range featureColorPalette {
+		validColors[color] = true
+	}
 
 	feature := sl.Current().Interface().(Feature)
 
@@ -237,67 +270,164 @@ func UserStructLevelValidation(sl validator.StructLevel) {
 	// plus can do more, even with different tag than "fnameorlname"
 }
 
-func (fi FeatureInterceptor) GetTile(rw http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	z, _ := vars["z"]
-	x, _ := vars["x"]
-	y, _ := vars["y"]
+// parseTileCoordinates reads z/x/y from the route and checks them against the
+// tileset zoom range, extended by the overzoom levels, and the 2^z bounds of
+// the zoom level.
+func (fi FeatureInterceptor) parseTileCoordinates(vars map[string]string) (uint8, uint64, uint64, error) {
+	z, err := strconv.ParseUint(vars["z"], 10, 8)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid zoom %q", vars["z"])
+	}
+	x, err := strconv.ParseUint(vars["x"], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid x %q", vars["x"])
+	}
+	y, err := strconv.ParseUint(vars["y"], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid y %q", vars["y"])
+	}
 
-	z_num, _ := strconv.Atoi(z)
-	x_num, _ := strconv.Atoi(x)
-	y_num, _ := strconv.Atoi(y)
+	minZoom, maxZoom := fi.servedZoomRange()
+	if uint8(z) < minZoom || uint8(z) > maxZoom {
+		return 0, 0, 0, fmt.Errorf("zoom %d outside of tileset range %d-%d", z, minZoom, maxZoom)
+	}
+	if n := uint64(1) << z; x >= n || y >= n {
+		return 0, 0, 0, fmt.Errorf("tile %d/%d/%d out of bounds", z, x, y)
+	}
 
-	tile, _ := fi.mbTileDB.GetTileData(uint8(z_num), uint64(x_num), uint64(y_num))
-	layers, _ := mvt.UnmarshalGzipped(tile)
+	return uint8(z), x, y, nil
+}
 
-	mergeIds := make([]string, 0)
+// servedZoomRange is the tileset zoom range plus the levels served by
+// overzooming the tileset max zoom.
+func (fi FeatureInterceptor) servedZoomRange() (uint8, uint8) {
+	minZoom, maxZoom := fi.tiles.ZoomRange()
+	if int(maxZoom)+int(fi.overzoom) > maxOverzoomLevel {
+		return minZoom, maxOverzoomLevel
+	}
+	return minZoom, maxZoom + fi.overzoom
+}
 
-	for _, l := range layers {
-		for _, f := range l.Features {
-			if mergeId, mIdOK := f.Properties["merge_id"]; mIdOK {
-				mergeIds = append(mergeIds, mergeId.(string))
-			}
-		}
+// renderTile returns the gzipped tile with the feature overlay and, at low
+// zooms, the cluster layer applied, or nil when the tileset has no such tile.
+func (fi FeatureInterceptor) renderTile(z uint8, x uint64, y uint64) ([]byte, error) {
+	tile, err := fi.overlaidTile(z, x, y)
+	if err != nil || tile == nil {
+		return tile, err
 	}
 
-	features := make([]Feature, 0)
+	tile, err = fi.addClusterLayer(z, x, y, tile)
+	if err != nil {
+		return nil, fmt.Errorf("adding clusters: %v", err)
+	}
+	return tile, nil
+}
 
-	fi.db.Where("merge_id In ?", mergeIds).Select("merge_id", "name", "color").Find(&features)
+// overlaidTile returns the gzipped tile with the feature overlay applied, or
+// nil when the tileset has no such tile. Tiles without customized features are
+// returned exactly as stored.
+func (fi FeatureInterceptor) overlaidTile(z uint8, x uint64, y uint64) ([]byte, error) {
+	if _, maxZoom := fi.tiles.ZoomRange(); z > maxZoom {
+		return fi.overzoomTile(z, x, y)
+	}
 
-	featuresMap := make(map[string]string)
-	mergeIdToColor :=  make(map[string]string)
+	tile, err := fi.tiles.GetTileData(z, x, y)
+	if err != nil {
+		return nil, fmt.Errorf("reading tile: %v", err)
+	}
 
-	for _, feat := range features {
-		featuresMap[feat.MergeId] = feat.Name
-		mergeIdToColor[feat.MergeId] = feat.Color
+	if tile == nil {
+		return nil, nil
 	}
 
-	for _, l := range layers {
-		for _, f := range l.Features {
-			mergeId, mIdOK := f.Properties["merge_id"]
-			if !mIdOK {
-				continue
-			}
+	customized, err := fi.tileHasCustomizedFeature(tile)
+	if err != nil {
+		return nil, fmt.Errorf("scanning tile: %v", err)
+	}
+	if !customized {
+		return tile, nil
+	}
 
-			if newName, ok := featuresMap[mergeId.(string)]; ok && newName != ""{
-					f.Properties["name"] = newName
-			}
+	layers, err := mvt.UnmarshalGzipped(tile)
+	if err != nil {
+		return nil, fmt.Errorf("decoding tile: %v", err)
+	}
 
+	if err := fi.overlayTile(layers); err != nil {
+		return nil, fmt.Errorf("overlaying tile: %v", err)
+	}
 
-			if color, ok := mergeIdToColor[mergeId.(string)]; ok && color != "" {
-				_, isBuilding := f.Properties["building"]
+	resultTile, err := mvt.MarshalGzipped(layers)
+	if err != nil {
+		return nil, fmt.Errorf("encoding tile: %v", err)
+	}
+	return resultTile, nil
+}
 
-				if isBuilding {
-					f.Properties["color"] = color
-				}
-			}
+// cachedTile serves the tile from the tile cache when there is one, and
+// renders and stores it otherwise. Filtered tiles are cut from the cached
+// unfiltered tile and stored as their own variant when the schema allows it.
+func (fi FeatureInterceptor) cachedTile(z uint8, x uint64, y uint64, filter tileFilter) ([]byte, error) {
+	variant := filter.key()
+	cache := fi.tileCache
+	if !fi.tileSchema.cacheable(filter) {
+		cache = nil
+	}
+	if cache != nil {
+		if data, ok := cache.Get(variant, z, x, y); ok {
+			return data, nil
+		}
+	}
 
+	var data []byte
+	var err error
+	if filter.empty() {
+		data, err = fi.renderTile(z, x, y)
+	} else {
+		data, err = fi.cachedTile(z, x, y, tileFilter{})
+		if err == nil && data != nil {
+			data, err = filter.applyGzipped(data)
 		}
 	}
+	if err != nil || data == nil || cache == nil {
+		return data, err
+	}
 
-	resultTile, _ := mvt.MarshalGzipped(layers)
-	rw.Header().Set("Content-Type", "x-protobuf")
-	rw.Header().Set("Content-Encoding", "gzip")
+	if err := cache.Put(variant, z, x, y, data); err != nil {
+		log.Printf("caching tile %d/%d/%d: %v", z, x, y, err)
+	}
+	return data, nil
+}
+
+func (fi FeatureInterceptor) GetTile(rw http.ResponseWriter, req *http.Request) {
+	z, x, y, err := fi.parseTileCoordinates(mux.Vars(req))
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := parseTileFilter(req.URL.Query())
+	if err := fi.tileSchema.validate(filter); err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resultTile, err := fi.cachedTile(z, x, y, filter)
+	if err != nil {
+		log.Printf("tile %d/%d/%d: %v", z, x, y, err)
+		http.Error(rw, "could not render tile", http.StatusInternalServerError)
+		return
+	}
+
+	if resultTile == nil {
+		rw.WriteHeader(fi.missingTileStatus)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	if isGzipped(resultTile) {
+		rw.Header().Set("Content-Encoding", "gzip")
+	}
 	rw.Write(resultTile)
 }
 
@@ -339,29 +469,30 @@ func (s *SearchServer) updateModifiedName(newName string, element *IndexableElem
 }
 
 
-func publicKeyFromString(s string) (publicKey []byte, err error) {
-	b, err := b58.Decode(s)
-	if err != nil || len(b) != ed25519.PublicKeySize {
-		return nil, err
+// ValicateSignatureIsByTheOwner checks the signature of message against the
+// keys of the current owner of the token and returns that owner and the
+// matching key. Unminted tokens have no owner whose key could match.
+func (fi *FeatureInterceptor) ValicateSignatureIsByTheOwner(signature []byte, mergeId string, message SignedMessage) (string, string, bool, error) {
+	owner, err := fi.nearInteractor.getOwnerByTokenId(mergeId)
+	if err != nil || owner == "" {
+		return "", "", false, err
 	}
-	return b, nil
+	publicKey, matched := fi.matchAccountKey(owner, message, signature)
+	return owner, publicKey, matched, nil
 }
 
-func (fi *FeatureInterceptor) ValicateSignatureIsByTheOwner(signatureDto SignatureDto, mergeId string) bool {
-	owner := fi.nearInteractor.getOwnerByTokenId(mergeId)
-	ownerPublicKeys := fi.nearInteractor.getAcountPublicKeys(owner)
-
-	for _, pk := range ownerPublicKeys {
-		publicKey, err := publicKeyFromString(pk)
+// matchAccountKey returns the access key of the account that signed message.
+func (fi *FeatureInterceptor) matchAccountKey(accountId string, message SignedMessage, signature []byte) (string, bool) {
+	for _, pk := range fi.nearInteractor.getAcountPublicKeys(accountId) {
+		publicKey, err := ParsePublicKey(pk)
 		if err != nil {
 			continue
 		}
-		matched := ed25519.Verify(publicKey, []byte(mergeId), []byte(signatureDto.Signature))
-		if matched {
-			return true
+		if publicKey.Verify(message, signature) {
+			return pk, true
 		}
 	}
-	return false
+	return "", false
 }
 
 func (fi *FeatureInterceptor) UpdateFeature(rw http.ResponseWriter, req *http.Request) {
@@ -382,48 +513,45 @@ func (fi *FeatureInterceptor) UpdateFeature(rw http.ResponseWriter, req *http.Re
 	var signatureDto SignatureDto
 	json.NewDecoder(rdr1).Decode(&signatureDto)
 
+	var feature Feature
+	rdr2 := ioutil.NopCloser(bytes.NewBuffer(buf))
+	json.NewDecoder(rdr2).Decode(&feature)
+	bodyHash := featureBodyHash(&feature)
+
+	// validated before the signature is checked, so a rejected body does not
+	// use up the nonce
 	validate = validator.New()
+	validate.RegisterStructValidation(UserStructLevelValidation, Feature{})
 
-	err = validate.Struct(signatureDto)
+	feature.Name = strings.TrimSpace(feature.Name)
+	err = validate.Struct(feature)
 
 	if err != nil {
 		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	isSignatureValid := fi.ValicateSignatureIsByTheOwner(signatureDto, mergeId)
 
+	owner, publicKey, isSignatureValid := fi.authorizeOwner(rw, req, signatureDto, "update", mergeId, bodyHash)
 	if !isSignatureValid {
-			rw.WriteHeader(http.StatusBadRequest)
-			return
+		return
 	}
 
-	var feature Feature
 	feature.MergeId = mergeId
-	rdr2 := ioutil.NopCloser(bytes.NewBuffer(buf))
-	json.NewDecoder(rdr2).Decode(&feature)
+	feature.Owner = owner
+	center := elementBound(elasticElement).Center()
+	feature.Lon, feature.Lat = center[0], center[1]
 
-	if err != nil {
-		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
-		return
-	}
+	fi.s.updateModifiedName(feature.Name, elasticElement)
 
-	validate = validator.New()
-	validate.RegisterStructValidation(UserStructLevelValidation, Feature{})
-
-	feature.Name = strings.TrimSpace(feature.Name)
-	err = validate.Struct(feature)
+	err = fi.saveFeature(&feature, &FeatureRevision{Signer: owner, PublicKey: publicKey, Signature: signatureDto.Signature})
 
 	if err != nil {
-		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		log.Printf("saving feature %s: %v", mergeId, err)
+		http.Error(rw, "could not save feature", http.StatusInternalServerError)
 		return
 	}
 
-	fi.s.updateModifiedName(feature.Name, elasticElement)
-
-	fi.db.Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "merge_id"}},                                                               // key colume
-		DoUpdates: clause.AssignmentColumns([]string{"name", "description", "embedded_link", "color", "link_to_vr"}), // column needed to be updated
-	}).Create(&feature)
+	fi.featureSaved(&feature, elasticElement)
 
 	rw.WriteHeader(http.StatusNoContent)
 	rw.Write([]byte{})
@@ -447,6 +575,35 @@ func (fi *FeatureInterceptor) GetExtendedFeature(elasticElement *IndexableElemen
 	return &feature
 }
 
+// countView mirrors the view counter of the search index into the Feature
+// row, so the tile overlay can read it in the same query as the
+// customizations. It is called after updateView counted the view.
+func (fi *FeatureInterceptor) countView(element *IndexableElement) {
+	center := elementBound(element).Center()
+	feature := Feature{MergeId: element.Merge_id, Views: element.View, Lon: center[0], Lat: center[1]}
+	err := fi.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "merge_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"views": element.View, "lon": center[0], "lat": center[1]}),
+	}).Create(&feature).Error
+	if err != nil {
+		log.Printf("counting view of %s: %v", element.Merge_id, err)
+		return
+	}
+
+	// views rank the features of a cluster, so its top feature may change
+	if fi.clusters != nil && fi.clusters.countView(element.Merge_id, element.View) {
+		fi.viewInvalidations.add(element)
+	}
+
+	if fi.tileProperties["view_bucket"] {
+		fi.customized.set(element.Merge_id, true)
+		// the bucket only changes at powers of ten, and tiles are invalidated in batches
+		if fi.viewInvalidations != nil && element.View > 0 && viewBucket(element.View) != viewBucket(element.View-1) {
+			fi.viewInvalidations.add(element)
+		}
+	}
+}
+
 func (fi *FeatureInterceptor) GetFeature(rw http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	mergeId, _ := vars["mergeId"]
@@ -459,6 +616,7 @@ func (fi *FeatureInterceptor) GetFeature(rw http.ResponseWriter, req *http.Reque
 	}
 
 	fi.s.updateView(elasticElement)
+	fi.countView(elasticElement)
     
 	feature := fi.GetExtendedFeature(elasticElement)
 
@@ -501,67 +659,178 @@ func (fi *FeatureInterceptor) ListFeatures(rw http.ResponseWriter, req *http.Req
 	rw.Write(body)
 }
 
-func (featureSigner *FeatureSigner) GetFeatureSignature(rw http.ResponseWriter, req *http.Request) {
-	vars := mux.Vars(req)
-	mergeId, _ := vars["mergeId"]
-
 
-	_, found := featureSigner.s.getElasticElement(mergeId)
-	if !found {
-		rw.WriteHeader(http.StatusNotFound)
-		return
+// openDB connects to the features database and migrates its schema.
+func openDB(dbPassword string) *gorm.DB {
+	dsn := fmt.Sprintf("host=localhost user=shizo password=%s dbname=shizo port=5432 sslmode=disable TimeZone=Etc/UTC", dbPassword)
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("opening database: %v", err)
 	}
 
-	data := []byte(mergeId)
-	signature := ed25519.Sign(featureSigner.privateKey[:], data)
-	signatureB58 := b58.Encode(signature[:])
-
-	rw.WriteHeader(http.StatusOK)
-	body, _ := json.Marshal(&SignatureDto{Signature: signatureB58})
-	rw.Write(body)
+	db.AutoMigrate(&Feature{}, &TileChange{}, &DataMigration{}, &FeatureRevision{}, &SignatureNonce{}, &AuthChallenge{}, &Session{}, &MintVoucher{})
+	return db
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "seed":
+			runSeed(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		}
+	}
+
 	var (
 		url         = flag.String("url", "http://localhost:9200", "Elasticsearch URL")
 		index       = flag.String("index", "dashaq", "Elasticsearch index name")
 		sniff       = flag.Bool("sniff", true, "Enable or disable sniffing")
-		mbtilesPath = flag.String("mbtiles", "/home/shinzo/Workspace/Personal/sibel-back/out/toronto-iterative-motorway-v4.mbtiles", "mbtiles path")
+		mbtilesPath = flag.String("mbtiles", "/home/shinzo/Workspace/Personal/sibel-back/out/toronto-iterative-motorway-v4.mbtiles", "mbtiles or pmtiles path")
 		dbPassword  = flag.String("dbPassword", "shizo", "db password")
-		nearPrivateKey  = flag.String("nearPrivateKey", "3xnCUnp51K8YhVMF492cpEHJNufwdiRjpUrRnurDYaJ7FHKx2XUcAXatNNcAkzquxdp5AJVkayiZAw5A9TR4wqes", "near private key")
+		signingKeys = flag.String("signingKeys", "", "keystore JSON file with the master signing keys, read from $"+signingKeysEnv+" when empty")
 		NearRPCNode	= flag.String("nearRPCNode", "https://rpc.testnet.near.org", "near rpc node adress")
 		NearMasterAccountId = flag.String("nearMasterAccountId", "shizotest.testnet", "near master account Id")
+		glyphsURL   = flag.String("glyphsURL", "https://demotiles.maplibre.org/font/{fontstack}/{range}.pbf", "glyphs url used by generated map styles")
+		tilePropertiesList = flag.String("tileProperties", strings.Join(defaultTileProperties, ","), "comma separated feature properties added to tiles, out of "+strings.Join(tileOverlayProperties, ","))
+		missingTileStatus = flag.Int("missingTileStatus", http.StatusNoContent, "status code for tiles missing from the tileset (204 or 404)")
+		overzoom = flag.Uint("overzoom", 4, "zoom levels past the tileset maxzoom served by scaling up stored tiles")
+		spatialIndexZoom = flag.Int("spatialIndexZoom", -1, "tileset zoom the spatial index is built from, the tileset maxzoom when negative")
+		tileCacheDir = flag.String("tileCacheDir", "", "directory for rendered tiles, caching is disabled when empty")
+		sessionTTL = flag.Duration("sessionTTL", time.Hour, "lifetime of wallet sign-in sessions")
+		mintPrice = flag.String("mintPrice", "0", "price in yoctoNEAR bound into mint vouchers")
+		voucherTTL = flag.Duration("voucherTTL", 15*time.Minute, "how long a mint voucher can be redeemed")
+		vouchersPerAccount = flag.Int("vouchersPerAccount", 10, "mint vouchers an account can get per day, unlimited when zero")
+		heatInterval = flag.Duration("heatInterval", 10*time.Minute, "how often the heat map of feature views is rebuilt, disabled when zero")
+		clusterMaxZoom = flag.Int("clusterMaxZoom", 12, "highest zoom whose tiles get the cluster layer of customized features, disabled when negative")
 	)
 
 	flag.Parse()
 
-	dsn := fmt.Sprintf("host=localhost user=shizo password=%s dbname=shizo port=5432 sslmode=disable TimeZone=Etc/UTC", *dbPassword)
-	db, _ := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if *missingTileStatus != http.StatusNoContent && *missingTileStatus != http.StatusNotFound {
+		log.Fatalf("missingTileStatus must be %d or %d", http.StatusNoContent, http.StatusNotFound)
+	}
+
+	if *overzoom > maxOverzoomLevel {
+		log.Fatalf("overzoom must not exceed %d", maxOverzoomLevel)
+	}
 
-	db.AutoMigrate(&Feature{})
+	tileProperties, err := parseTileProperties(*tilePropertiesList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := openDB(*dbPassword)
 
 	client := getClient(*url, *sniff)
 
-	mbTileDB, _ := NewDB(*mbtilesPath)
+	tiles, err := OpenTileSource(*mbtilesPath)
+	if err != nil {
+		log.Fatalf("opening tiles: %v", err)
+	}
 
 	searchServer := SearchServer{client: client, index: *index}
 
 	nearInteractor := NearInteractor{RPCNode: *NearRPCNode, MasterAccountId: *NearMasterAccountId}
 
-	featureInterceptor := FeatureInterceptor{db: db, mbTileDB: mbTileDB, s: &searchServer, nearInteractor: &nearInteractor}
+	featureInterceptor := FeatureInterceptor{db: db, tiles: tiles, s: &searchServer, nearInteractor: &nearInteractor, missingTileStatus: *missingTileStatus, glyphsURL: *glyphsURL, tileProperties: tileProperties, customized: newMergeIdSet(), overzoom: uint8(*overzoom), clusterMaxZoom: *clusterMaxZoom, sessionTTL: *sessionTTL}
 	
-	privateKey, _ := b58.Decode(*nearPrivateKey)
+	if *tileCacheDir != "" {
+		_, maxZoom := tiles.ZoomRange()
+		featureInterceptor.tileCache = &TileCache{Dir: *tileCacheDir, MaxZoom: maxZoom}
+	}
+	if tileProperties["view_bucket"] || *clusterMaxZoom >= 0 {
+		featureInterceptor.viewInvalidations = newPendingInvalidations()
+	}
+
+	metadata, err := tiles.Metadata()
+	if err != nil {
+		log.Fatalf("reading tileset metadata: %v", err)
+	}
+	featureInterceptor.tileSchema = newTileSchema(metadata)
+
+	if err := featureInterceptor.loadCustomizedFeatures(); err != nil {
+		log.Fatalf("loading customized features: %v", err)
+	}
+
+	if *heatInterval > 0 {
+		// before the clusters load, so that they rank by the backfilled views
+		if err := backfillViews(db, &searchServer); err != nil {
+			log.Printf("backfilling view counts: %v", err)
+		}
+		featureInterceptor.heat = &HeatMap{}
+		featureInterceptor.heatInterval = *heatInterval
+		go featureInterceptor.heat.Schedule(db, &searchServer, *heatInterval)
+	}
+
+	if *clusterMaxZoom >= 0 {
+		featureInterceptor.clusters = newClusterIndex()
+		if err := featureInterceptor.clusters.load(db, &searchServer); err != nil {
+			log.Fatalf("loading clusters: %v", err)
+		}
+	}
+
+	if featureInterceptor.viewInvalidations != nil {
+		go featureInterceptor.flushViewInvalidations(viewInvalidationInterval)
+	}
+
+	spatialIndex := &SpatialIndex{}
+	go func() {
+		_, z := tiles.ZoomRange()
+		if *spatialIndexZoom >= 0 {
+			z = uint8(*spatialIndexZoom)
+		}
+		if err := spatialIndex.Build(featureInterceptor, z); err != nil {
+			log.Printf("building spatial index: %v", err)
+		}
+	}()
+
+	keys, err := loadKeystore(*signingKeys)
+	if err != nil {
+		log.Fatalf("loading signing keys: %v", err)
+	}
+	if keys == nil {
+		log.Printf("no signing keys configured, mint vouchers are disabled")
+	}
+
+	price, err := parseMintPrice(*mintPrice)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	featureSigner := FeatureSigner{s: &searchServer, db: db, nearInteractor: &nearInteractor, keys: keys, rules: MintRules{Price: price, VoucherTTL: *voucherTTL, PerAccountLimit: *vouchersPerAccount}}
 
-	featureSigner := FeatureSigner{s: &searchServer, privateKey: privateKey}
 
+	verifier := &Verifier{fi: &featureInterceptor, signer: &featureSigner}
 
 	r := mux.NewRouter()
 
+	r.HandleFunc("/tiles/heat/{z}/{x}/{y}", featureInterceptor.GetHeatTile).Methods("GET")
+	r.HandleFunc("/tiles/changes", featureInterceptor.GetTileChanges).Methods("GET")
 	r.HandleFunc("/tiles/{z}/{x}/{y}", featureInterceptor.GetTile).Methods("GET")
+	r.HandleFunc("/styles/{name}.json", featureInterceptor.GetStyle).Methods("GET")
+	r.HandleFunc("/auth/challenge", featureInterceptor.CreateChallenge).Methods("POST")
+	r.HandleFunc("/auth/session", featureInterceptor.CreateSession).Methods("POST")
+	r.HandleFunc("/auth/session", featureInterceptor.DeleteSession).Methods("DELETE")
 	r.HandleFunc("/features/{mergeId}/", featureInterceptor.UpdateFeature).Methods("PUT")
 	r.HandleFunc("/features/{mergeId}/", featureInterceptor.GetFeature).Methods("GET")
-	r.HandleFunc("/features/{mergeId}/signature/", featureSigner.GetFeatureSignature).Methods("GET")
+	r.HandleFunc("/features/{mergeId}/history", featureInterceptor.GetFeatureHistory).Methods("GET")
+	r.HandleFunc("/features/{mergeId}/revisions/{n}", featureInterceptor.GetFeatureRevision).Methods("GET")
+	r.HandleFunc("/features/{mergeId}/revisions/{n}/restore", featureInterceptor.RestoreFeatureRevision).Methods("POST")
+	r.HandleFunc("/features/{mergeId}/geometry", featureInterceptor.GetFeatureGeometry).Methods("GET")
+	r.HandleFunc("/features/{mergeId}/svg", featureInterceptor.GetFeatureSVG).Methods("GET")
+	r.HandleFunc("/features/{mergeId}/neighbors/", spatialIndex.HandleNeighbors).Methods("GET")
+	r.HandleFunc("/static/{lon:-?[0-9.]+},{lat:-?[0-9.]+},{zoom:[0-9.]+}/{w:[0-9]+}x{h:[0-9]+}.png", featureInterceptor.GetStaticMap).Methods("GET")
+	r.HandleFunc("/static/features/{mergeId}/{w:[0-9]+}x{h:[0-9]+}.png", featureInterceptor.GetFeatureStaticMap).Methods("GET")
+	r.HandleFunc("/spatial/at/", spatialIndex.HandleAt).Methods("GET")
+	r.HandleFunc("/spatial/within/", spatialIndex.HandleWithin).Methods("GET")
+	r.HandleFunc("/spatial/nearest/", spatialIndex.HandleNearest).Methods("GET")
+	r.HandleFunc("/features/{mergeId}/signature/", featureSigner.GetFeatureSignature).Methods("POST")
+	r.HandleFunc("/features/{mergeId}/signature/", featureSigner.GoneFeatureSignature).Methods("GET")
 	r.HandleFunc("/features/list/", featureInterceptor.ListFeatures).Methods("POST")
+	r.HandleFunc("/verify", verifier.HandleVerify).Methods("POST")
 	r.HandleFunc("/search/", searchServer.handleGet).
 		Queries("q", "{q}").
 		Queries("lat", "{lat}").
@@ -2,11 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 
 	_ "github.com/mattn/go-sqlite3" // import sqlite3 driver
 
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -14,6 +16,8 @@ type MBTileDB struct {
     FileName  string    // name of tile mbtiles file
     DB        *sql.DB   // database connection for mbtiles file
     Timestamp time.Time // timestamp of file, for cache control headers
+    MinZoom   uint8     // minimum zoom level available in the tileset
+    MaxZoom   uint8     // maximum zoom level available in the tileset
 }
 
 func NewDB(filename string) (*MBTileDB, error) {
@@ -33,10 +37,57 @@ func NewDB(filename string) (*MBTileDB, error) {
         Timestamp: fileStat.ModTime().Round(time.Second), 
     }
 
+    if err := out.readZoomRange(); err != nil {
+        return nil, err
+    }
+
     return &out, nil
 
 }
 
+// readZoomRange loads minzoom and maxzoom from the metadata table, falling back
+// to the zoom levels actually present in the tiles table when they are missing.
+func (tileset *MBTileDB) readZoomRange() error {
+    metadata, err := tileset.ReadMetadata()
+    if err != nil {
+        return err
+    }
+
+    minZoom, minErr := strconv.ParseUint(metadata["minzoom"], 10, 8)
+    maxZoom, maxErr := strconv.ParseUint(metadata["maxzoom"], 10, 8)
+    if minErr != nil || maxErr != nil {
+        var min, max sql.NullInt64
+        err := tileset.DB.QueryRow("select min(zoom_level), max(zoom_level) from tiles").Scan(&min, &max)
+        if err != nil {
+            return fmt.Errorf("could not read zoom range of mbtiles file: %v", err)
+        }
+        minZoom, maxZoom = uint64(min.Int64), uint64(max.Int64)
+    }
+
+    tileset.MinZoom = uint8(minZoom)
+    tileset.MaxZoom = uint8(maxZoom)
+    return nil
+}
+
+// ReadMetadata returns the name/value pairs stored in the metadata table.
+func (tileset *MBTileDB) ReadMetadata() (map[string]string, error) {
+    rows, err := tileset.DB.Query("select name, value from metadata")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    metadata := make(map[string]string)
+    for rows.Next() {
+        var name, value string
+        if err := rows.Scan(&name, &value); err != nil {
+            return nil, err
+        }
+        metadata[name] = value
+    }
+    return metadata, rows.Err()
+}
+
 func (tileset *MBTileDB) ReadTile(z uint8, x uint64, y uint64, data *[]byte) error {
     err := tileset.DB.QueryRow("select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?", z, x, y).Scan(data)
     if err != nil {
@@ -63,4 +114,53 @@ func (db *MBTileDB) GetTileData(z uint8, x uint64, y uint64) ([]byte, error) {
         return nil, nil
     }
     return data, nil
-}
\ No newline at end of file
+}
+
+func (db *MBTileDB) ZoomRange() (uint8, uint8) {
+    return db.MinZoom, db.MaxZoom
+}
+
+// Metadata returns the metadata table as TileJSON, with the embedded "json"
+// entry (vector_layers and friends) merged into the top level.
+func (db *MBTileDB) Metadata() (map[string]interface{}, error) {
+    rows, err := db.ReadMetadata()
+    if err != nil {
+        return nil, err
+    }
+
+    metadata := make(map[string]interface{})
+    for name, value := range rows {
+        if name == "json" {
+            continue
+        }
+        metadata[name] = value
+    }
+
+    if raw, ok := rows["json"]; ok {
+        if err := json.Unmarshal([]byte(raw), &metadata); err != nil {
+            return nil, fmt.Errorf("could not parse mbtiles json metadata: %v", err)
+        }
+    }
+    return metadata, nil
+}
+
+func (db *MBTileDB) ForEachTile(fn func(z uint8, x uint64, y uint64) error) error {
+    rows, err := db.DB.Query("select zoom_level, tile_column, tile_row from tiles")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var z uint8
+        var x, y uint64
+        if err := rows.Scan(&z, &x, &y); err != nil {
+            return err
+        }
+        // flip y back from TMS to XYZ
+        if err := fn(z, x, (1<<uint64(z))-1-y); err != nil {
+            return err
+        }
+    }
+    return rows.Err()
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+    "time"
+
     "gorm.io/gorm"
 )
 
@@ -12,5 +14,93 @@ type Feature struct {
     EmbeddedLink       string    `json:"embedded_link" validate:"omitempty,url"`
     Color     string `json:"color" validate:"omitempty,hexcolor"`
 	LinkToVR	string `json:"link_to_vr" validate:"omitempty,url"`
+    Owner       string `json:"owner"`
+    Views       uint64 `json:"-"`
+    // center of the search index bounding box, for the low zoom clusters
+    Lon         float64 `json:"-"`
+    Lat         float64 `json:"-"`
+
+}
+
+// IsCustomized reports whether the owner has set any of the editable fields.
+func (feature *Feature) IsCustomized() bool {
+    return feature.Name != "" || feature.Description != "" || feature.EmbeddedLink != "" ||
+        feature.Color != "" || feature.LinkToVR != ""
+}
+
+// TileChange records a write that changed the overlay of the tiles covering
+// the bounding box. Its ID is the sequence number of the change feed.
+type TileChange struct {
+    ID        uint64    `gorm:"primarykey"`
+    CreatedAt time.Time `gorm:"index"`
+    MergeId   string
+    MinLon    float64
+    MinLat    float64
+    MaxLon    float64
+    MaxLat    float64
+}
+
+// DataMigration records a one-time data migration that has run, so that it
+// is not repeated on the next start.
+type DataMigration struct {
+    Name      string    `gorm:"primarykey"`
+    CreatedAt time.Time
+}
+
+// FeatureRevision is an append-only copy of every customization saved by an
+// owner. Revision counts from 1 for each feature.
+type FeatureRevision struct {
+    ID           uint64    `json:"-" gorm:"primarykey"`
+    CreatedAt    time.Time `json:"created_at"`
+    MergeId      string    `json:"merge_id" gorm:"uniqueIndex:idx_feature_revision"`
+    Revision     uint      `json:"revision" gorm:"uniqueIndex:idx_feature_revision"`
+    Name         string    `json:"name"`
+    Description  string    `json:"description"`
+    EmbeddedLink string    `json:"embedded_link"`
+    Color        string    `json:"color"`
+    LinkToVR     string    `json:"link_to_vr"`
+    Signer       string    `json:"signer"`
+    PublicKey    string    `json:"public_key"`
+    Signature    string    `json:"signature"`
+    RestoredFrom uint      `json:"restored_from,omitempty"`
+}
+
+// SignatureNonce is a nonce of an accepted owner signature, kept until the
+// signature expires so it cannot be replayed.
+type SignatureNonce struct {
+    Nonce     string    `gorm:"primarykey"`
+    MergeId   string
+    ExpiresAt time.Time `gorm:"index"`
+    CreatedAt time.Time
+}
+
+// AuthChallenge is a login nonce handed out to a wallet, used up by the
+// first session request that names it.
+type AuthChallenge struct {
+    Nonce     string    `gorm:"primarykey"`
+    AccountId string
+    ExpiresAt time.Time `gorm:"index"`
+}
+
+// Session is a logged in wallet account. Only the hash of the token is kept.
+type Session struct {
+    TokenHash string    `gorm:"primarykey"`
+    AccountId string
+    PublicKey string
+    ExpiresAt time.Time `gorm:"index"`
+    CreatedAt time.Time
+}
 
+// MintVoucher is every voucher the master key signed, kept to enforce the
+// mint rules and to audit what was issued.
+type MintVoucher struct {
+    ID        uint64    `gorm:"primarykey"`
+    CreatedAt time.Time `gorm:"index"`
+    MergeId   string    `gorm:"index"`
+    Recipient string    `gorm:"index"`
+    Price     string
+    Nonce     string    `gorm:"uniqueIndex"`
+    ExpiresAt time.Time
+    KeyId     string
+    Signature string
 }
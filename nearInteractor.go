@@ -30,15 +30,29 @@ type AccessKeyListResponse struct {
     Result struct {
 		Keys [] struct {
 			PublicKey string	`json:"public_key"`
+			AccessKey struct {
+				// "FullAccess", or an object for FunctionCall keys
+				Permission json.RawMessage `json:"permission"`
+			} `json:"access_key"`
 		} `json:"keys"`
 	}    `json:"result"`
 }
 
+// fullAccessPermission is the permission of keys that can act for the account.
+const fullAccessPermission = "FullAccess"
+
 
 type ViewNftListResponse struct {
     Result struct {
 		Result	[]byte	`json:"result"`
 	}     `json:"result"`
+	Error	*RPCError	`json:"error"`
+}
+
+type RPCError struct {
+	Name    string          `json:"name"`
+	Message string          `json:"message"`
+	Cause   json.RawMessage `json:"cause"`
 }
 
 type RPCRequest struct {
@@ -54,6 +68,9 @@ type NearInteractor struct {
 	MasterAccountId string
 }
 
+// getAcountPublicKeys lists the full access keys of the account. FunctionCall
+// keys are left out: wallets hand them to any app the user signs in to, so
+// they do not prove the account holder signed.
 func (nearInteractor *NearInteractor) getAcountPublicKeys(accountId string) []string {
     params := AccessKeyListRequestParams{RequestType: "view_access_key_list", Finality: "final", AccountId: accountId}
 
@@ -77,14 +94,20 @@ func (nearInteractor *NearInteractor) getAcountPublicKeys(accountId string) []st
 
 	publicKeys := make([]string, 0)
 	for _, k := range res.Result.Keys {
-		publicKeys = append(publicKeys, k.PublicKey)
+		var permission string
+		if json.Unmarshal(k.AccessKey.Permission, &permission) == nil && permission == fullAccessPermission {
+			publicKeys = append(publicKeys, k.PublicKey)
+		}
 	}
 
 	return publicKeys
 
 }
 
-func (nearInteractor *NearInteractor) getOwnerByTokenId(tokenId string) string {
+// getOwnerByTokenId returns the owner of the token, or "" when the token was
+// never minted. Any RPC failure is an error, so that callers can tell it
+// apart from a token without owner.
+func (nearInteractor *NearInteractor) getOwnerByTokenId(tokenId string) (string, error) {
 	ArgsBase64 :=  b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("{\"token_id\": \"%v\"}", tokenId)))
 	params := ViewNftRequestParams{ArgsBase64: ArgsBase64, RequestType: "call_function", Finality: "optimistic", AccountId: nearInteractor.MasterAccountId, MethodName: "nft_token"}
 
@@ -93,19 +116,45 @@ func (nearInteractor *NearInteractor) getOwnerByTokenId(tokenId string) string {
 
     jsonData, _ := json.Marshal(&req)
 
-	request, error := http.NewRequest("POST", nearInteractor.RPCNode, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequest("POST", nearInteractor.RPCNode, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", err
+	}
 	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
 
 	client := &http.Client{}
-	response, error := client.Do(request)
-	if error != nil {
-		panic(error)
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("querying owner of %s: %v", tokenId, err)
 	}
 	defer response.Body.Close()
-    
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("querying owner of %s: rpc status %d", tokenId, response.StatusCode)
+	}
+
 	var res ViewNftListResponse
-	json.NewDecoder(response.Body).Decode(&res)
-	var v map[string]interface{}
-	json.Unmarshal(res.Result.Result, &v)
-	return v["owner_id"].(string)
-}
\ No newline at end of file
+	if err := json.NewDecoder(response.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("decoding owner of %s: %v", tokenId, err)
+	}
+	if res.Error != nil {
+		return "", fmt.Errorf("querying owner of %s: %s: %s", tokenId, res.Error.Name, res.Error.Message)
+	}
+	if res.Result.Result == nil {
+		return "", fmt.Errorf("querying owner of %s: empty rpc result", tokenId)
+	}
+
+	// nft_token returns null for tokens that were never minted
+	var token *struct {
+		OwnerId string `json:"owner_id"`
+	}
+	if err := json.Unmarshal(res.Result.Result, &token); err != nil {
+		return "", fmt.Errorf("decoding token %s: %v", tokenId, err)
+	}
+	if token == nil {
+		return "", nil
+	}
+	if token.OwnerId == "" {
+		return "", fmt.Errorf("token %s has no owner_id", tokenId)
+	}
+	return token.OwnerId, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// signatureStandardNEP413 marks signatures made by a wallet's signMessage,
+// see https://github.com/near/NEPs/blob/master/neps/nep-0413.md
+const signatureStandardNEP413 = "nep413"
+
+// nep413Tag is the borsh u32 prefix that keeps NEP-413 payloads from ever
+// being valid transactions: 2^31 + 413.
+const nep413Tag uint32 = 1<<31 + 413
+
+type nep413Payload struct {
+	Message     string
+	Nonce       [32]byte
+	Recipient   string
+	CallbackUrl *string
+}
+
+// borsh serializes the tag and the payload: strings are a u32 little endian
+// length and UTF-8 bytes, the nonce is 32 raw bytes and the callback URL is
+// an option, a 0 or 1 byte followed by the string when present.
+func (p nep413Payload) borsh() []byte {
+	buf := make([]byte, 0, 4+4+len(p.Message)+32+4+len(p.Recipient)+1)
+
+	var u32 [4]byte
+	writeUint32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(u32[:], v)
+		buf = append(buf, u32[:]...)
+	}
+	writeString := func(s string) {
+		writeUint32(uint32(len(s)))
+		buf = append(buf, s...)
+	}
+
+	writeUint32(nep413Tag)
+	writeString(p.Message)
+	buf = append(buf, p.Nonce[:]...)
+	writeString(p.Recipient)
+	if p.CallbackUrl == nil {
+		buf = append(buf, 0)
+	} else {
+		buf = append(buf, 1)
+		writeString(*p.CallbackUrl)
+	}
+	return buf
+}
+
+// hash is what the wallet signs.
+func (p nep413Payload) hash() []byte {
+	sum := sha256.Sum256(p.borsh())
+	return sum[:]
+}
+
+// nep413SignedBytes wraps message the way signMessage does. The wallet
+// returns the nonce and, unless another encoding is given, the signature
+// base64 encoded, and the recipient has to be
+// this service, so a signature made for another app is never accepted. The
+// wallet signs the hash of the payload, which is returned as a digest.
+func nep413SignedBytes(signatureDto SignatureDto, message []byte, recipient string) (SignedMessage, []byte, error) {
+	if signatureDto.Recipient != recipient {
+		return SignedMessage{}, nil, fmt.Errorf("recipient must be %q", recipient)
+	}
+
+	nonce, err := b64.StdEncoding.DecodeString(signatureDto.Nonce)
+	if err != nil || len(nonce) != 32 {
+		return SignedMessage{}, nil, fmt.Errorf("nonce must be 32 base64 encoded bytes")
+	}
+
+	encoding := signatureDto.SignatureEncoding
+	if encoding == "" {
+		encoding = signatureEncodingBase64
+	}
+	signature, err := DecodeSignature(signatureDto.Signature, encoding)
+	if err != nil {
+		return SignedMessage{}, nil, fmt.Errorf("decoding signature: %v", err)
+	}
+
+	payload := nep413Payload{Message: string(message), Recipient: signatureDto.Recipient, CallbackUrl: signatureDto.CallbackUrl}
+	copy(payload.Nonce[:], nonce)
+	return SignedMessage{Data: payload.hash(), Digest: true}, signature, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+)
+
+// tileOverlayProperties are the properties GetTile can write onto tile
+// features from their Feature rows, in the order they are documented.
+//
+//	name            custom name; the original one is kept in osm_name
+//	color           owner color, buildings only
+//	customized      true when the owner set any field
+//	has_description true when a description is set
+//	has_media       true when an embedded link is set
+//	has_vr          true when a VR link is set
+//	view_bucket     order of magnitude of the view count (0, 1-9, 10-99, ...)
+//	owner           short id of the owner account
+var tileOverlayProperties = []string{
+	"name", "color", "customized", "has_description", "has_media", "has_vr", "view_bucket", "owner",
+}
+
+// defaultTileProperties leaves out view_bucket: it changes with every view
+// count and puts every viewed feature into the overlay, so it is opt-in.
+var defaultTileProperties = []string{
+	"name", "color", "customized", "has_description", "has_media", "has_vr", "owner",
+}
+
+// parseTileProperties turns a comma separated property list into the set
+// used by the tile overlay.
+func parseTileProperties(list string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, p := range tileOverlayProperties {
+		known[p] = true
+	}
+
+	properties := make(map[string]bool)
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !known[p] {
+			return nil, fmt.Errorf("unknown tile property %q", p)
+		}
+		properties[p] = true
+	}
+	return properties, nil
+}
+
+func tileMergeIds(layers mvt.Layers) []string {
+	mergeIds := make([]string, 0)
+
+	for _, l := range layers {
+		for _, f := range l.Features {
+			if mergeId, ok := f.Properties["merge_id"].(string); ok {
+				mergeIds = append(mergeIds, mergeId)
+			}
+		}
+	}
+	return mergeIds
+}
+
+// overlayTile loads the Feature rows of every feature in the tile with one
+// query and writes the configured overlay properties onto them.
+func (fi FeatureInterceptor) overlayTile(layers mvt.Layers) error {
+	mergeIds := tileMergeIds(layers)
+	if len(mergeIds) == 0 {
+		return nil
+	}
+
+	features := make([]Feature, 0)
+
+	err := fi.db.Where("merge_id In ?", mergeIds).
+		Select("merge_id", "name", "description", "embedded_link", "color", "link_to_vr", "owner", "views").
+		Find(&features).Error
+	if err != nil {
+		return err
+	}
+
+	featuresMap := make(map[string]*Feature)
+	for i := range features {
+		featuresMap[features[i].MergeId] = &features[i]
+	}
+
+	for _, l := range layers {
+		for _, f := range l.Features {
+			mergeId, ok := f.Properties["merge_id"].(string)
+			if !ok {
+				continue
+			}
+
+			if feature, ok := featuresMap[mergeId]; ok {
+				fi.overlayFeature(f.Properties, feature)
+			}
+		}
+	}
+	return nil
+}
+
+func (fi FeatureInterceptor) overlayFeature(properties geojson.Properties, feature *Feature) {
+	if fi.tileProperties["name"] && feature.Name != "" {
+		// keep the original name around so styles can label custom names differently
+		osmName, _ := properties["name"].(string)
+		properties["osm_name"] = osmName
+		properties["name"] = feature.Name
+	}
+
+	if fi.tileProperties["color"] && feature.Color != "" {
+		if _, isBuilding := properties["building"]; isBuilding {
+			properties["color"] = feature.Color
+		}
+	}
+
+	if fi.tileProperties["customized"] && feature.IsCustomized() {
+		properties["customized"] = true
+	}
+
+	if fi.tileProperties["has_description"] && feature.Description != "" {
+		properties["has_description"] = true
+	}
+
+	if fi.tileProperties["has_media"] && feature.EmbeddedLink != "" {
+		properties["has_media"] = true
+	}
+
+	if fi.tileProperties["has_vr"] && feature.LinkToVR != "" {
+		properties["has_vr"] = true
+	}
+
+	if fi.tileProperties["view_bucket"] {
+		properties["view_bucket"] = viewBucket(feature.Views)
+	}
+
+	if fi.tileProperties["owner"] && feature.Owner != "" {
+		properties["owner"] = ownerShortId(feature.Owner)
+	}
+}
+
+// viewBucket returns the number of decimal digits of the view count, so that
+// tiles carry a coarse popularity level instead of exact counts.
+func viewBucket(views uint64) int {
+	bucket := 0
+	for ; views > 0; views /= 10 {
+		bucket++
+	}
+	return bucket
+}
+
+// ownerShortId is a compact, stable id for an owner account that lets clients
+// group features by owner without shipping full account names in every tile.
+func ownerShortId(owner string) string {
+	sum := sha256.Sum256([]byte(owner))
+	return hex.EncodeToString(sum[:4])
+}
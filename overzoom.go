@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/maptile"
+)
+
+// maxOverzoomLevel is the highest zoom served, whatever the overzoom setting.
+const maxOverzoomLevel = 24
+
+// overzoomBuffer is the share of the tile extent kept around an overzoomed
+// tile, so lines and polygon edges do not show seams at tile borders.
+const overzoomBuffer = 1.0 / 64
+
+// overzoomTile builds a tile beyond the tileset max zoom from its nearest
+// stored ancestor: the ancestor geometries are projected onto the requested
+// tile, clipped to it and overlaid like any other tile. It returns nil when no
+// ancestor exists or nothing of it falls inside the tile.
+func (fi FeatureInterceptor) overzoomTile(z uint8, x uint64, y uint64) ([]byte, error) {
+	minZoom, maxZoom := fi.tiles.ZoomRange()
+	requested := maptile.New(uint32(x), uint32(y), maptile.Zoom(z))
+
+	for az := int(maxZoom); az >= int(minZoom); az-- {
+		shift := uint(z) - uint(az)
+		ancestor := maptile.New(uint32(x>>shift), uint32(y>>shift), maptile.Zoom(az))
+
+		tile, err := fi.tiles.GetTileData(uint8(az), uint64(ancestor.X), uint64(ancestor.Y))
+		if err != nil {
+			return nil, fmt.Errorf("reading ancestor tile: %v", err)
+		}
+		if tile == nil {
+			continue
+		}
+
+		return fi.scaleAncestorTile(tile, ancestor, requested)
+	}
+	return nil, nil
+}
+
+func (fi FeatureInterceptor) scaleAncestorTile(tile []byte, ancestor maptile.Tile, requested maptile.Tile) ([]byte, error) {
+	customized, err := fi.tileHasCustomizedFeature(tile)
+	if err != nil {
+		return nil, fmt.Errorf("scanning ancestor tile: %v", err)
+	}
+
+	layers, err := mvt.UnmarshalGzipped(tile)
+	if err != nil {
+		return nil, fmt.Errorf("decoding ancestor tile: %v", err)
+	}
+
+	layers.ProjectToWGS84(ancestor)
+	layers.ProjectToTile(requested)
+
+	empty := true
+	for _, l := range layers {
+		buffer := float64(l.Extent) * overzoomBuffer
+		l.Clip(orb.Bound{
+			Min: orb.Point{-buffer, -buffer},
+			Max: orb.Point{float64(l.Extent) + buffer, float64(l.Extent) + buffer},
+		})
+		l.RemoveEmpty(1, 1)
+
+		if len(l.Features) > 0 {
+			empty = false
+		}
+	}
+	if empty {
+		return nil, nil
+	}
+
+	if customized {
+		if err := fi.overlayTile(layers); err != nil {
+			return nil, fmt.Errorf("overlaying tile: %v", err)
+		}
+	}
+
+	resultTile, err := mvt.MarshalGzipped(layers)
+	if err != nil {
+		return nil, fmt.Errorf("encoding tile: %v", err)
+	}
+	return resultTile, nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	pmtilesHeaderLength = 127
+	pmtilesMaxDepth     = 4
+
+	pmtilesCompressionUnknown = 0
+	pmtilesCompressionNone    = 1
+	pmtilesCompressionGzip    = 2
+
+	pmtilesTileTypeMVT = 1
+)
+
+type pmtilesHeader struct {
+	RootOffset          uint64
+	RootLength          uint64
+	MetadataOffset      uint64
+	MetadataLength      uint64
+	LeafDirectoryOffset uint64
+	LeafDirectoryLength uint64
+	TileDataOffset      uint64
+	TileDataLength      uint64
+	InternalCompression uint8
+	TileCompression     uint8
+	TileType            uint8
+	MinZoom             uint8
+	MaxZoom             uint8
+}
+
+type pmtilesEntry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+// PMTiles reads vector tiles from a local PMTiles v3 archive.
+type PMTiles struct {
+	FileName  string    // name of the pmtiles archive
+	Timestamp time.Time // timestamp of file, for cache control headers
+
+	file   *os.File
+	header pmtilesHeader
+	root   []pmtilesEntry
+	leaves *directoryCache
+}
+
+func NewPMTiles(filename string) (*PMTiles, error) {
+	fileStat, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file stats for pmtiles file: %s", filename)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, pmtilesHeaderLength)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not read pmtiles header: %v", err)
+	}
+
+	header, err := parsePMTilesHeader(buf)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	out := PMTiles{
+		FileName:  filename,
+		Timestamp: fileStat.ModTime().Round(time.Second),
+		file:      file,
+		header:    header,
+		leaves:    newDirectoryCache(64),
+	}
+
+	out.root, err = out.readDirectory(header.RootOffset, header.RootLength)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+func parsePMTilesHeader(b []byte) (pmtilesHeader, error) {
+	var h pmtilesHeader
+	if string(b[0:7]) != "PMTiles" {
+		return h, errors.New("not a pmtiles archive")
+	}
+	if b[7] != 3 {
+		return h, fmt.Errorf("unsupported pmtiles spec version %d", b[7])
+	}
+
+	h.RootOffset = binary.LittleEndian.Uint64(b[8:16])
+	h.RootLength = binary.LittleEndian.Uint64(b[16:24])
+	h.MetadataOffset = binary.LittleEndian.Uint64(b[24:32])
+	h.MetadataLength = binary.LittleEndian.Uint64(b[32:40])
+	h.LeafDirectoryOffset = binary.LittleEndian.Uint64(b[40:48])
+	h.LeafDirectoryLength = binary.LittleEndian.Uint64(b[48:56])
+	h.TileDataOffset = binary.LittleEndian.Uint64(b[56:64])
+	h.TileDataLength = binary.LittleEndian.Uint64(b[64:72])
+	h.InternalCompression = b[97]
+	h.TileCompression = b[98]
+	h.TileType = b[99]
+	h.MinZoom = b[100]
+	h.MaxZoom = b[101]
+
+	if h.InternalCompression != pmtilesCompressionNone && h.InternalCompression != pmtilesCompressionGzip {
+		return h, fmt.Errorf("unsupported pmtiles directory compression %d", h.InternalCompression)
+	}
+	if h.TileCompression != pmtilesCompressionUnknown && h.TileCompression != pmtilesCompressionNone && h.TileCompression != pmtilesCompressionGzip {
+		return h, fmt.Errorf("unsupported pmtiles tile compression %d", h.TileCompression)
+	}
+	if h.TileType != pmtilesTileTypeMVT {
+		return h, fmt.Errorf("unsupported pmtiles tile type %d", h.TileType)
+	}
+
+	return h, nil
+}
+
+func (p *PMTiles) ZoomRange() (uint8, uint8) {
+	return p.header.MinZoom, p.header.MaxZoom
+}
+
+// GetTileData walks the root and leaf directories for the tile and returns it
+// gzipped, so callers get the same encoding as from an MBTiles file.
+func (p *PMTiles) GetTileData(z uint8, x uint64, y uint64) ([]byte, error) {
+	tileID := zxyToTileID(z, x, y)
+	entries := p.root
+
+	for depth := 0; depth < pmtilesMaxDepth; depth++ {
+		entry, ok := findTileEntry(entries, tileID)
+		if !ok {
+			return nil, nil
+		}
+
+		if entry.RunLength > 0 {
+			data := make([]byte, entry.Length)
+			if _, err := p.file.ReadAt(data, int64(p.header.TileDataOffset+entry.Offset)); err != nil {
+				return nil, err
+			}
+			if len(data) <= 1 {
+				return nil, nil
+			}
+			if p.header.TileCompression == pmtilesCompressionNone {
+				return gzipBytes(data)
+			}
+			return data, nil
+		}
+
+		var err error
+		entries, err = p.leafDirectory(p.header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("pmtiles directory is nested too deeply")
+}
+
+// Metadata reads the JSON metadata section of the archive.
+func (p *PMTiles) Metadata() (map[string]interface{}, error) {
+	data := make([]byte, p.header.MetadataLength)
+	if _, err := p.file.ReadAt(data, int64(p.header.MetadataOffset)); err != nil {
+		return nil, fmt.Errorf("could not read pmtiles metadata: %v", err)
+	}
+
+	var reader io.Reader = bytes.NewReader(data)
+	if p.header.InternalCompression == pmtilesCompressionGzip {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress pmtiles metadata: %v", err)
+		}
+		reader = gz
+	}
+
+	metadata := make(map[string]interface{})
+	if err := json.NewDecoder(reader).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("could not parse pmtiles metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+func (p *PMTiles) ForEachTile(fn func(z uint8, x uint64, y uint64) error) error {
+	return p.forEachEntry(p.root, 0, fn)
+}
+
+func (p *PMTiles) forEachEntry(entries []pmtilesEntry, depth int, fn func(z uint8, x uint64, y uint64) error) error {
+	if depth >= pmtilesMaxDepth {
+		return errors.New("pmtiles directory is nested too deeply")
+	}
+
+	for _, entry := range entries {
+		if entry.RunLength == 0 {
+			leaf, err := p.leafDirectory(p.header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length))
+			if err != nil {
+				return err
+			}
+			if err := p.forEachEntry(leaf, depth+1, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for i := uint64(0); i < uint64(entry.RunLength); i++ {
+			z, x, y := tileIDToZxy(entry.TileID + i)
+			if err := fn(z, x, y); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *PMTiles) leafDirectory(offset uint64, length uint64) ([]pmtilesEntry, error) {
+	if entries, ok := p.leaves.get(offset); ok {
+		return entries, nil
+	}
+
+	entries, err := p.readDirectory(offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	p.leaves.add(offset, entries)
+	return entries, nil
+}
+
+func (p *PMTiles) readDirectory(offset uint64, length uint64) ([]pmtilesEntry, error) {
+	data := make([]byte, length)
+	if _, err := p.file.ReadAt(data, int64(offset)); err != nil {
+		return nil, fmt.Errorf("could not read pmtiles directory: %v", err)
+	}
+
+	var reader io.Reader = bytes.NewReader(data)
+	if p.header.InternalCompression == pmtilesCompressionGzip {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress pmtiles directory: %v", err)
+		}
+		reader = gz
+	}
+
+	return deserializePMTilesEntries(bufio.NewReader(reader))
+}
+
+func deserializePMTilesEntries(r io.ByteReader) ([]pmtilesEntry, error) {
+	numEntries, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the count comes from the file, so grow the slice as entries are read
+	// instead of trusting it for the allocation
+	entries := make([]pmtilesEntry, 0, minUint64(numEntries, 4096))
+
+	var lastID uint64
+	for i := uint64(0); i < numEntries; i++ {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		lastID += delta
+		entries = append(entries, pmtilesEntry{TileID: lastID})
+	}
+
+	for i := range entries {
+		runLength, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].RunLength = uint32(runLength)
+	}
+
+	for i := range entries {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Length = uint32(length)
+	}
+
+	for i := range entries {
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		// an offset of zero means the entry directly follows the previous one
+		if i > 0 && offset == 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = offset - 1
+		}
+	}
+
+	return entries, nil
+}
+
+func minUint64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// findTileEntry returns the entry covering tileID: either an exact match, a
+// run of identical tiles containing it, or the leaf directory it falls into.
+func findTileEntry(entries []pmtilesEntry, tileID uint64) (pmtilesEntry, bool) {
+	m, n := 0, len(entries)-1
+	for m <= n {
+		k := (m + n) >> 1
+		if tileID > entries[k].TileID {
+			m = k + 1
+		} else if tileID < entries[k].TileID {
+			n = k - 1
+		} else {
+			return entries[k], true
+		}
+	}
+
+	if n >= 0 {
+		if entries[n].RunLength == 0 || tileID-entries[n].TileID < uint64(entries[n].RunLength) {
+			return entries[n], true
+		}
+	}
+	return pmtilesEntry{}, false
+}
+
+// zxyToTileID maps a tile onto its position along the per-zoom Hilbert curve,
+// offset by the number of tiles in all lower zoom levels.
+func zxyToTileID(z uint8, x uint64, y uint64) uint64 {
+	acc := ((uint64(1) << (2 * uint64(z))) - 1) / 3
+
+	for s := (uint64(1) << z) >> 1; s > 0; s >>= 1 {
+		var rx, ry uint64
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		acc += s * s * ((3 * rx) ^ ry)
+
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return acc
+}
+
+// tileIDToZxy is the inverse of zxyToTileID.
+func tileIDToZxy(id uint64) (uint8, uint64, uint64) {
+	z := uint8(bits.Len64(3*id+1)-1) / 2
+	d := id - ((uint64(1)<<(2*uint64(z)))-1)/3
+
+	var x, y uint64
+	for s := uint64(1); s < uint64(1)<<z; s <<= 1 {
+		rx := 1 & (d >> 1)
+		ry := 1 & (d ^ rx)
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+		x += s * rx
+		y += s * ry
+		d >>= 2
+	}
+	return z, x, y
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// directoryCache keeps the most recently used leaf directories in memory.
+type directoryCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[uint64]*list.Element
+}
+
+type directoryCacheItem struct {
+	offset  uint64
+	entries []pmtilesEntry
+}
+
+func newDirectoryCache(size int) *directoryCache {
+	return &directoryCache{size: size, order: list.New(), entries: make(map[uint64]*list.Element)}
+}
+
+func (c *directoryCache) get(offset uint64) ([]pmtilesEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[offset]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*directoryCacheItem).entries, true
+}
+
+func (c *directoryCache) add(offset uint64, entries []pmtilesEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[offset]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[offset] = c.order.PushFront(&directoryCacheItem{offset: offset, entries: entries})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*directoryCacheItem).offset)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestZxyToTileID(t *testing.T) {
+	tests := []struct {
+		z    uint8
+		x, y uint64
+		want uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{12, 3423, 1763, 19078479},
+	}
+	for _, tt := range tests {
+		if got := zxyToTileID(tt.z, tt.x, tt.y); got != tt.want {
+			t.Errorf("zxyToTileID(%d, %d, %d) = %d, want %d", tt.z, tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestZxyToTileIDCoversEachZoom(t *testing.T) {
+	for z := uint8(0); z <= 5; z++ {
+		first := (uint64(1)<<(2*uint64(z)) - 1) / 3
+		seen := make(map[uint64]bool)
+		for x := uint64(0); x < 1<<z; x++ {
+			for y := uint64(0); y < 1<<z; y++ {
+				id := zxyToTileID(z, x, y)
+				if id < first || id >= first+1<<(2*uint64(z)) || seen[id] {
+					t.Fatalf("zoom %d: tile %d/%d has id %d outside the zoom or taken twice", z, x, y, id)
+				}
+				seen[id] = true
+			}
+		}
+	}
+}
+
+// serializePMTilesEntries writes a directory the way the spec lays it out,
+// with consecutive tiles stored as offset 0.
+func serializePMTilesEntries(entries []pmtilesEntry) []byte {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	write := func(v uint64) {
+		buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+	}
+
+	write(uint64(len(entries)))
+	var lastID uint64
+	for _, e := range entries {
+		write(e.TileID - lastID)
+		lastID = e.TileID
+	}
+	for _, e := range entries {
+		write(uint64(e.RunLength))
+	}
+	for _, e := range entries {
+		write(uint64(e.Length))
+	}
+	for i, e := range entries {
+		if i > 0 && e.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			write(0)
+		} else {
+			write(e.Offset + 1)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestPMTilesDirectoryRoundTrip(t *testing.T) {
+	entries := []pmtilesEntry{
+		{TileID: 0, Offset: 0, Length: 10, RunLength: 1},
+		{TileID: 1, Offset: 10, Length: 20, RunLength: 1},
+		{TileID: 5, Offset: 100, Length: 5, RunLength: 3},
+		{TileID: 40, Offset: 105, Length: 7, RunLength: 0},
+	}
+
+	got, err := deserializePMTilesEntries(bytes.NewReader(serializePMTilesEntries(entries)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("got %+v, want %+v", got, entries)
+	}
+}
+
+func TestPMTilesDirectoryHostileInput(t *testing.T) {
+	valid := serializePMTilesEntries([]pmtilesEntry{
+		{TileID: 3, Offset: 0, Length: 10, RunLength: 1},
+		{TileID: 4, Offset: 10, Length: 10, RunLength: 1},
+	})
+
+	tests := map[string][]byte{
+		"empty":              {},
+		"truncated":          valid[:len(valid)-1],
+		"huge entry count":   {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f},
+		"unterminated count": {0xff, 0xff},
+		"overlong varint":    {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+	}
+	for name, data := range tests {
+		if _, err := deserializePMTilesEntries(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestFindTileEntry(t *testing.T) {
+	entries := []pmtilesEntry{
+		{TileID: 2, Length: 1, RunLength: 1},
+		{TileID: 10, Length: 1, RunLength: 4},
+		{TileID: 20, Length: 1, RunLength: 0},
+	}
+
+	tests := []struct {
+		tileID uint64
+		want   uint64
+		found  bool
+	}{
+		{1, 0, false},
+		{2, 2, true},
+		{3, 0, false},
+		{10, 10, true},
+		{13, 10, true},
+		{14, 0, false},
+		{25, 20, true}, // leaf directories cover everything after them
+	}
+	for _, tt := range tests {
+		entry, found := findTileEntry(entries, tt.tileID)
+		if found != tt.found || (found && entry.TileID != tt.want) {
+			t.Errorf("findTileEntry(%d) = %d, %v, want %d, %v", tt.tileID, entry.TileID, found, tt.want, tt.found)
+		}
+	}
+	if _, found := findTileEntry(nil, 0); found {
+		t.Error("found a tile in an empty directory")
+	}
+}
+
+// writePMTiles builds an uncompressed archive whose root directory points at
+// a leaf directory holding the tiles.
+func writePMTiles(t *testing.T, tiles map[uint64][]byte, ids []uint64) string {
+	var data bytes.Buffer
+	leaf := make([]pmtilesEntry, 0, len(ids))
+	for _, id := range ids {
+		leaf = append(leaf, pmtilesEntry{TileID: id, Offset: uint64(data.Len()), Length: uint32(len(tiles[id])), RunLength: 1})
+		data.Write(tiles[id])
+	}
+	leafDir := serializePMTilesEntries(leaf)
+	root := serializePMTilesEntries([]pmtilesEntry{{TileID: ids[0], Offset: 0, Length: uint32(len(leafDir)), RunLength: 0}})
+
+	header := make([]byte, pmtilesHeaderLength)
+	copy(header, "PMTiles")
+	header[7] = 3
+	rootOffset := uint64(pmtilesHeaderLength)
+	leafOffset := rootOffset + uint64(len(root))
+	dataOffset := leafOffset + uint64(len(leafDir))
+	for i, v := range []uint64{rootOffset, uint64(len(root)), dataOffset, 0, leafOffset, uint64(len(leafDir)), dataOffset, uint64(data.Len())} {
+		binary.LittleEndian.PutUint64(header[8+8*i:], v)
+	}
+	header[97] = pmtilesCompressionNone
+	header[98] = pmtilesCompressionNone
+	header[99] = pmtilesTileTypeMVT
+	header[100], header[101] = 0, 2
+
+	var file bytes.Buffer
+	file.Write(header)
+	file.Write(root)
+	file.Write(leafDir)
+	file.Write(data.Bytes())
+
+	name := filepath.Join(t.TempDir(), "test.pmtiles")
+	if err := os.WriteFile(name, file.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestPMTilesGetTileData(t *testing.T) {
+	tiles := map[uint64][]byte{
+		zxyToTileID(1, 0, 0): []byte("tile 1/0/0"),
+		zxyToTileID(1, 1, 1): []byte("tile 1/1/1"),
+		zxyToTileID(2, 3, 2): []byte("tile 2/3/2"),
+	}
+	ids := []uint64{zxyToTileID(1, 0, 0), zxyToTileID(1, 1, 1), zxyToTileID(2, 3, 2)}
+
+	p, err := NewPMTiles(writePMTiles(t, tiles, ids))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		z    uint8
+		x, y uint64
+		want string
+	}{
+		{1, 0, 0, "tile 1/0/0"},
+		{1, 1, 1, "tile 1/1/1"},
+		{2, 3, 2, "tile 2/3/2"},
+		{1, 0, 1, ""},
+		{0, 0, 0, ""},
+	} {
+		data, err := p.GetTileData(tt.z, tt.x, tt.y)
+		if err != nil {
+			t.Fatalf("%d/%d/%d: %v", tt.z, tt.x, tt.y, err)
+		}
+		if tt.want == "" {
+			if data != nil {
+				t.Errorf("%d/%d/%d: got a tile for a missing one", tt.z, tt.x, tt.y)
+			}
+			continue
+		}
+		// uncompressed archives are served gzipped
+		plain, err := gunzipForTest(data)
+		if err != nil || string(plain) != tt.want {
+			t.Errorf("%d/%d/%d = %q (%v), want %q", tt.z, tt.x, tt.y, plain, err, tt.want)
+		}
+	}
+}
+
+func TestParsePMTilesHeaderRejectsOtherFiles(t *testing.T) {
+	header := make([]byte, pmtilesHeaderLength)
+	copy(header, "SQLite format 3")
+	if _, err := parsePMTilesHeader(header); err == nil {
+		t.Error("accepted a file that is not a pmtiles archive")
+	}
+
+	copy(header, "PMTiles")
+	header[7] = 2
+	if _, err := parsePMTilesHeader(header); err == nil {
+		t.Error("accepted a v2 archive")
+	}
+}
+
+func gunzipForTest(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(gz)
+}
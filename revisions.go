@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// saveFeature upserts the Feature row and appends its revision in one
+// transaction, so the history never misses a write that went through.
+func (fi *FeatureInterceptor) saveFeature(feature *Feature, revision *FeatureRevision) error {
+	return fi.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "merge_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"name", "description", "embedded_link", "color", "link_to_vr", "owner", "lon", "lat"}),
+		}).Create(feature).Error
+		if err != nil {
+			return err
+		}
+
+		// concurrent saves of the feature wait here for each other, so no two
+		// of them read the same last revision
+		var locked Feature
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").
+			Where("merge_id = ?", feature.MergeId).First(&locked).Error
+		if err != nil {
+			return err
+		}
+
+		var last uint
+		err = tx.Model(&FeatureRevision{}).Where("merge_id = ?", feature.MergeId).
+			Select("coalesce(max(revision), 0)").Scan(&last).Error
+		if err != nil {
+			return err
+		}
+
+		revision.MergeId = feature.MergeId
+		revision.Revision = last + 1
+		revision.Name = feature.Name
+		revision.Description = feature.Description
+		revision.EmbeddedLink = feature.EmbeddedLink
+		revision.Color = feature.Color
+		revision.LinkToVR = feature.LinkToVR
+		return tx.Create(revision).Error
+	})
+}
+
+// featureSaved brings the in-memory sets, the tile cache and the change feed
+// in line with a saved Feature row.
+func (fi *FeatureInterceptor) featureSaved(feature *Feature, element *IndexableElement) {
+	fi.customized.set(feature.MergeId, fi.affectsTile(feature))
+	if fi.clusters != nil {
+		fi.clusters.set(feature)
+	}
+	fi.tilesChanged(element)
+}
+
+// RestoreFeatureRevision serves /features/{mergeId}/revisions/{n}/restore. The
+// current owner authorizes the request the same way as UpdateFeature, with a
+// session or a signature over the "restore" action and a body of
+// {"revision":"<n>"}, and the
+// customization of revision n is saved again as a new revision, so the
+// history stays append-only.
+func (fi *FeatureInterceptor) RestoreFeatureRevision(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	mergeId := vars["mergeId"]
+
+	n, err := strconv.ParseUint(vars["n"], 10, 32)
+	if err != nil || n == 0 {
+		http.Error(rw, "Request Error revision must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	var signatureDto SignatureDto
+	// a session request may come without a body
+	if err := json.NewDecoder(req.Body).Decode(&signatureDto); err != nil && err != io.EOF {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	elasticElement, found := fi.s.getElasticElement(mergeId)
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	owner, publicKey, isSignatureValid := fi.authorizeOwner(rw, req, signatureDto, "restore", mergeId, restoreBodyHash(n))
+	if !isSignatureValid {
+		return
+	}
+
+	revision, found, err := fi.featureRevision(mergeId, uint(n))
+	if err != nil {
+		log.Printf("reading revision %d of %s: %v", n, mergeId, err)
+		http.Error(rw, "could not read feature revision", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	center := elementBound(elasticElement).Center()
+	feature := Feature{
+		MergeId:      mergeId,
+		Name:         revision.Name,
+		Description:  revision.Description,
+		EmbeddedLink: revision.EmbeddedLink,
+		Color:        revision.Color,
+		LinkToVR:     revision.LinkToVR,
+		Owner:        owner,
+		Lon:          center[0],
+		Lat:          center[1],
+	}
+
+	// the search index only lags behind on failure, the restore itself goes on
+	if err := fi.s.updateModifiedName(feature.Name, elasticElement); err != nil {
+		log.Printf("updating search name of %s: %v", mergeId, err)
+	}
+
+	restored := FeatureRevision{Signer: owner, PublicKey: publicKey, Signature: signatureDto.Signature, RestoredFrom: revision.Revision}
+	if err := fi.saveFeature(&feature, &restored); err != nil {
+		log.Printf("restoring revision %d of %s: %v", n, mergeId, err)
+		http.Error(rw, "could not save feature", http.StatusInternalServerError)
+		return
+	}
+
+	fi.featureSaved(&feature, elasticElement)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(&restored)
+	rw.Write(body)
+}
+
+// GetFeatureHistory lists every revision of the feature, oldest first.
+func (fi *FeatureInterceptor) GetFeatureHistory(rw http.ResponseWriter, req *http.Request) {
+	mergeId := mux.Vars(req)["mergeId"]
+
+	revisions := make([]FeatureRevision, 0)
+	if err := fi.db.Where("merge_id = ?", mergeId).Order("revision").Find(&revisions).Error; err != nil {
+		log.Printf("reading history of %s: %v", mergeId, err)
+		http.Error(rw, "could not read feature history", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(&revisions)
+	rw.Write(body)
+}
+
+// GetFeatureRevision returns revision n of the feature.
+func (fi *FeatureInterceptor) GetFeatureRevision(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	mergeId := vars["mergeId"]
+
+	n, err := strconv.ParseUint(vars["n"], 10, 32)
+	if err != nil || n == 0 {
+		http.Error(rw, "Request Error revision must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	revision, found, err := fi.featureRevision(mergeId, uint(n))
+	if err != nil {
+		log.Printf("reading revision %d of %s: %v", n, mergeId, err)
+		http.Error(rw, "could not read feature revision", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(revision)
+	rw.Write(body)
+}
+
+func (fi *FeatureInterceptor) featureRevision(mergeId string, n uint) (*FeatureRevision, bool, error) {
+	revisions := make([]FeatureRevision, 0)
+	err := fi.db.Where("merge_id = ? AND revision = ?", mergeId, n).Limit(1).Find(&revisions).Error
+	if err != nil || len(revisions) == 0 {
+		return nil, false, err
+	}
+	return &revisions[0], true, nil
+}
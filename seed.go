@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+type tileJob struct {
+	z    uint8
+	x, y uint64
+}
+
+// rendererFlags are the flags shared by the offline commands that render tiles
+// through the same overlay path as GetTile.
+type rendererFlags struct {
+	mbtilesPath        *string
+	dbPassword         *string
+	tilePropertiesList *string
+	workers            *int
+	clusterMaxZoom     *int
+}
+
+func addRendererFlags(fs *flag.FlagSet) rendererFlags {
+	return rendererFlags{
+		mbtilesPath:        fs.String("mbtiles", "/home/shinzo/Workspace/Personal/sibel-back/out/toronto-iterative-motorway-v4.mbtiles", "mbtiles or pmtiles path"),
+		dbPassword:         fs.String("dbPassword", "shizo", "db password"),
+		tilePropertiesList: fs.String("tileProperties", strings.Join(defaultTileProperties, ","), "comma separated feature properties added to tiles, out of "+strings.Join(tileOverlayProperties, ",")),
+		workers:            fs.Int("workers", runtime.NumCPU(), "number of tiles rendered in parallel"),
+		clusterMaxZoom:     fs.Int("clusterMaxZoom", 12, "highest zoom whose tiles get the cluster layer of customized features, disabled when negative"),
+	}
+}
+
+// openRenderer builds a FeatureInterceptor that can render tiles but serves no
+// requests, so it needs neither Elasticsearch nor NEAR.
+func (flags rendererFlags) openRenderer() FeatureInterceptor {
+	tileProperties, err := parseTileProperties(*flags.tilePropertiesList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tiles, err := OpenTileSource(*flags.mbtilesPath)
+	if err != nil {
+		log.Fatalf("opening tiles: %v", err)
+	}
+
+	fi := FeatureInterceptor{db: openDB(*flags.dbPassword), tiles: tiles, tileProperties: tileProperties, customized: newMergeIdSet(), clusterMaxZoom: *flags.clusterMaxZoom}
+	if err := fi.loadCustomizedFeatures(); err != nil {
+		log.Fatalf("loading customized features: %v", err)
+	}
+
+	if *flags.clusterMaxZoom >= 0 {
+		fi.clusters = newClusterIndex()
+		if err := fi.clusters.load(fi.db, nil); err != nil {
+			log.Fatalf("loading clusters: %v", err)
+		}
+	}
+	return fi
+}
+
+// renderTiles renders every tile produced by walk on a pool of workers and
+// hands the non-missing ones to write, logging progress and throughput.
+func renderTiles(fi FeatureInterceptor, walk func(emit func(tileJob)) error, total uint64, workers int, write func(tileJob, []byte) error) error {
+	var done, failed uint64
+
+	jobs := make(chan tileJob, workers*4)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				data, err := fi.renderTile(job.z, job.x, job.y)
+				if err == nil && data != nil {
+					err = write(job, data)
+				}
+				if err != nil {
+					log.Printf("tile %d/%d/%d: %v", job.z, job.x, job.y, err)
+					atomic.AddUint64(&failed, 1)
+				}
+				atomic.AddUint64(&done, 1)
+			}
+		}()
+	}
+
+	start := time.Now()
+	stopProgress := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logRenderProgress(atomic.LoadUint64(&done), total, start)
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+
+	log.Printf("rendering %d tiles with %d workers", total, workers)
+	err := walk(func(job tileJob) { jobs <- job })
+	close(jobs)
+	wg.Wait()
+	close(stopProgress)
+
+	if err != nil {
+		return fmt.Errorf("walking tileset: %v", err)
+	}
+
+	logRenderProgress(done, total, start)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tiles failed", failed, done)
+	}
+	return nil
+}
+
+func logRenderProgress(done uint64, total uint64, start time.Time) {
+	elapsed := time.Since(start).Seconds()
+	percent := 100.0
+	if total > 0 {
+		percent = float64(done) / float64(total) * 100
+	}
+	log.Printf("rendered %d/%d tiles (%.1f%%), %.1f tiles/s", done, total, percent, float64(done)/elapsed)
+}
+
+// walkTileset emits every stored tile within the zoom range.
+func walkTileset(tiles TileSource, minZoom uint8, maxZoom uint8) (func(emit func(tileJob)) error, uint64) {
+	walk := func(emit func(tileJob)) error {
+		return tiles.ForEachTile(func(z uint8, x uint64, y uint64) error {
+			if z >= minZoom && z <= maxZoom {
+				emit(tileJob{z, x, y})
+			}
+			return nil
+		})
+	}
+
+	var total uint64
+	walk(func(tileJob) { total++ })
+	return walk, total
+}
+
+// walkBound emits every tile covering the bound within the zoom range.
+func walkBound(bound orb.Bound, minZoom uint8, maxZoom uint8) (func(emit func(tileJob)) error, uint64) {
+	walk := func(emit func(tileJob)) error {
+		for z := int(minZoom); z <= int(maxZoom); z++ {
+			minX, minY, maxX, maxY := tileRange(bound, uint8(z))
+			for x := minX; x <= maxX; x++ {
+				for y := minY; y <= maxY; y++ {
+					emit(tileJob{uint8(z), x, y})
+				}
+			}
+		}
+		return nil
+	}
+
+	var total uint64
+	for z := int(minZoom); z <= int(maxZoom); z++ {
+		minX, minY, maxX, maxY := tileRange(bound, uint8(z))
+		total += (maxX - minX + 1) * (maxY - minY + 1)
+	}
+	return walk, total
+}
+
+// runSeed renders tiles through the same overlay path as GetTile and writes
+// them to a tile directory, usually the -tileCacheDir of the server:
+//
+//	server seed -out /var/cache/tiles -bbox -79.6,43.6,-79.3,43.8 -minzoom 12 -maxzoom 16
+//
+// Without -bbox every tile stored in the tileset is rendered.
+func runSeed(args []string) {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	var (
+		renderer    = addRendererFlags(fs)
+		out         = fs.String("out", "", "directory the tiles are written to, e.g. the server tileCacheDir")
+		bbox        = fs.String("bbox", "", "west,south,east,north bounds to seed, the whole tileset when empty")
+		minZoomFlag = fs.Int("minzoom", -1, "lowest zoom to seed, the tileset minzoom when negative")
+		maxZoomFlag = fs.Int("maxzoom", -1, "highest zoom to seed, the tileset maxzoom when negative")
+	)
+	fs.Parse(args)
+
+	if *out == "" {
+		log.Fatal("seed: -out is required")
+	}
+
+	fi := renderer.openRenderer()
+
+	minZoom, maxZoom := fi.tiles.ZoomRange()
+	if *minZoomFlag >= 0 {
+		minZoom = uint8(*minZoomFlag)
+	}
+	if *maxZoomFlag >= 0 {
+		maxZoom = uint8(*maxZoomFlag)
+	}
+
+	var walk func(emit func(tileJob)) error
+	var total uint64
+	if *bbox != "" {
+		bound, err := parseBBox(*bbox)
+		if err != nil {
+			log.Fatal(err)
+		}
+		walk, total = walkBound(bound, minZoom, maxZoom)
+	} else {
+		walk, total = walkTileset(fi.tiles, minZoom, maxZoom)
+	}
+
+	_, storedMaxZoom := fi.tiles.ZoomRange()
+	cache := &TileCache{Dir: *out, MaxZoom: storedMaxZoom}
+	err := renderTiles(fi, walk, total, *renderer.workers, func(job tileJob, data []byte) error {
+		return cache.Put("", job.z, job.x, job.y, data)
+	})
+	if err != nil {
+		log.Fatalf("seed: %v", err)
+	}
+}
+
+func parseBBox(s string) (orb.Bound, error) {
+	var w, south, e, n float64
+	if _, err := fmt.Sscanf(s, "%g,%g,%g,%g", &w, &south, &e, &n); err != nil {
+		return orb.Bound{}, fmt.Errorf("invalid bbox %q, expected west,south,east,north", s)
+	}
+	if w > e || south > n {
+		return orb.Bound{}, fmt.Errorf("invalid bbox %q, west/south must not exceed east/north", s)
+	}
+	return orb.Bound{Min: orb.Point{w, south}, Max: orb.Point{e, n}}, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// challengeLifetime is how long a wallet has to sign a login challenge.
+const challengeLifetime = 5 * time.Minute
+
+var errInvalidSession = errors.New("invalid or expired session")
+
+type ChallengeRequestDto struct {
+	AccountId string `json:"account_id" validate:"required"`
+}
+
+// ChallengeDto is the login challenge. Message is the exact text to sign,
+// Nonce is 32 random bytes in base64, ready for a NEP-413 signMessage.
+type ChallengeDto struct {
+	AccountId string `json:"account_id"`
+	Nonce     string `json:"nonce"`
+	Expires   int64  `json:"expires"`
+	Message   string `json:"message"`
+}
+
+// SessionRequestDto answers a challenge with its nonce and the signature of
+// its message, in any of the signature standards of owner requests.
+type SessionRequestDto struct {
+	AccountId string `json:"account_id" validate:"required"`
+	SignatureDto
+}
+
+type SessionDto struct {
+	Token     string `json:"token"`
+	AccountId string `json:"account_id"`
+	Expires   int64  `json:"expires"`
+}
+
+// loginMessage is the text a wallet signs to log in, in the format of
+// signedMessage:
+//
+//	shizo-signed-message:v1
+//	action:login
+//	account_id:<account_id>
+//	nonce:<nonce>
+//	expires:<unix seconds>
+func loginMessage(accountId string, nonce string, expires int64) []byte {
+	return []byte(strings.Join([]string{
+		signedMessageHeader,
+		"action:login",
+		"account_id:" + accountId,
+		"nonce:" + nonce,
+		fmt.Sprintf("expires:%d", expires),
+	}, "\n"))
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b64.StdEncoding.EncodeToString(b), nil
+}
+
+// sessionTokenHash is what the sessions table stores, so a leaked table does
+// not leak usable tokens.
+func sessionTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateChallenge serves POST /auth/challenge.
+func (fi *FeatureInterceptor) CreateChallenge(rw http.ResponseWriter, req *http.Request) {
+	var dto ChallengeRequestDto
+	json.NewDecoder(req.Body).Decode(&dto)
+	if err := validator.New().Struct(dto); err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		log.Printf("creating challenge: %v", err)
+		http.Error(rw, "could not create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	challenge := AuthChallenge{Nonce: nonce, AccountId: dto.AccountId, ExpiresAt: now.Add(challengeLifetime)}
+	err = fi.db.Where("expires_at < ?", now).Delete(&AuthChallenge{}).Error
+	if err == nil {
+		err = fi.db.Create(&challenge).Error
+	}
+	if err != nil {
+		log.Printf("storing challenge for %s: %v", dto.AccountId, err)
+		http.Error(rw, "could not create challenge", http.StatusInternalServerError)
+		return
+	}
+
+	expires := challenge.ExpiresAt.Unix()
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(&ChallengeDto{
+		AccountId: dto.AccountId,
+		Nonce:     nonce,
+		Expires:   expires,
+		Message:   string(loginMessage(dto.AccountId, nonce, expires)),
+	})
+	rw.Write(body)
+}
+
+// CreateSession serves POST /auth/session. The challenge is used up whether
+// or not the signature verifies, and the session is bound to the account and
+// the key that signed.
+func (fi *FeatureInterceptor) CreateSession(rw http.ResponseWriter, req *http.Request) {
+	var dto SessionRequestDto
+	json.NewDecoder(req.Body).Decode(&dto)
+	if err := validator.New().Struct(dto); err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	challenges := make([]AuthChallenge, 0)
+	err := fi.db.Clauses(clause.Returning{}).
+		Where("nonce = ? AND account_id = ?", dto.Nonce, dto.AccountId).
+		Delete(&challenges).Error
+	if err != nil {
+		log.Printf("reading challenge for %s: %v", dto.AccountId, err)
+		http.Error(rw, "could not verify challenge", http.StatusInternalServerError)
+		return
+	}
+	if len(challenges) == 0 || !challenges[0].ExpiresAt.After(now) {
+		http.Error(rw, "Request Error unknown or expired challenge", http.StatusBadRequest)
+		return
+	}
+
+	expires := challenges[0].ExpiresAt.Unix()
+	message, signature, err := fi.signedBytes(dto.SignatureDto, loginMessage(dto.AccountId, dto.Nonce, expires))
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	publicKey, matched := fi.matchAccountKey(dto.AccountId, message, signature)
+	if !matched {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("creating session: %v", err)
+		http.Error(rw, "could not create session", http.StatusInternalServerError)
+		return
+	}
+
+	session := Session{TokenHash: sessionTokenHash(token), AccountId: dto.AccountId, PublicKey: publicKey, ExpiresAt: now.Add(fi.sessionTTL)}
+	err = fi.db.Where("expires_at < ?", now).Delete(&Session{}).Error
+	if err == nil {
+		err = fi.db.Create(&session).Error
+	}
+	if err != nil {
+		log.Printf("storing session for %s: %v", dto.AccountId, err)
+		http.Error(rw, "could not create session", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(&SessionDto{Token: token, AccountId: dto.AccountId, Expires: session.ExpiresAt.Unix()})
+	rw.Write(body)
+}
+
+// DeleteSession serves DELETE /auth/session and logs the bearer token out.
+func (fi *FeatureInterceptor) DeleteSession(rw http.ResponseWriter, req *http.Request) {
+	token, ok := bearerToken(req)
+	if !ok {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := fi.db.Where("token_hash = ?", sessionTokenHash(token)).Delete(&Session{}).Error; err != nil {
+		log.Printf("deleting session: %v", err)
+		http.Error(rw, "could not delete session", http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) || len(header) == len(prefix) {
+		return "", false
+	}
+	return header[len(prefix):], true
+}
+
+// findSession returns the unexpired session of the token. A session whose
+// key is no longer a full access key of its account is deleted and treated as
+// invalid, so removing the key ends it.
+func findSession(db *gorm.DB, nearInteractor *NearInteractor, token string) (*Session, error) {
+	sessions := make([]Session, 0)
+	err := db.Where("token_hash = ? AND expires_at > ?", sessionTokenHash(token), time.Now()).
+		Limit(1).Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, errInvalidSession
+	}
+
+	session := &sessions[0]
+	for _, pk := range nearInteractor.getAcountPublicKeys(session.AccountId) {
+		if pk == session.PublicKey {
+			return session, nil
+		}
+	}
+	if err := db.Where("token_hash = ?", session.TokenHash).Delete(&Session{}).Error; err != nil {
+		log.Printf("deleting session of %s: %v", session.AccountId, err)
+	}
+	return nil, errInvalidSession
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator"
+	"gorm.io/gorm/clause"
+)
+
+// Owner requests are signed over a message that binds the action, the
+// feature, a hash of the request body, a nonce and an expiry, so a captured
+// signature can neither be replayed nor reused for a different body. The
+// format is documented for clients in README.md.
+const (
+	signedMessageHeader  = "shizo-signed-message:v1"
+	maxSignatureLifetime = time.Hour
+	minNonceLength       = 16
+	maxNonceLength       = 128
+)
+
+var (
+	errSignatureExpired = errors.New("signature expired")
+	errExpiryTooFar     = fmt.Errorf("expires must be within %s", maxSignatureLifetime)
+	errInvalidNonce     = fmt.Errorf("nonce must be %d to %d characters", minNonceLength, maxNonceLength)
+	errNonceUsed        = errors.New("nonce already used")
+)
+
+// signedMessage is the exact byte string the owner signs:
+//
+//	shizo-signed-message:v1
+//	action:<action>
+//	merge_id:<merge_id>
+//	body_sha256:<lowercase hex sha256 of the canonical body>
+//	nonce:<nonce>
+//	expires:<unix seconds>
+//
+// with lines separated by a single "\n" and no trailing newline.
+func signedMessage(action string, mergeId string, bodyHash string, signatureDto SignatureDto) []byte {
+	return []byte(strings.Join([]string{
+		signedMessageHeader,
+		"action:" + action,
+		"merge_id:" + mergeId,
+		"body_sha256:" + bodyHash,
+		"nonce:" + signatureDto.Nonce,
+		fmt.Sprintf("expires:%d", signatureDto.Expires),
+	}, "\n"))
+}
+
+// canonicalBodyHash hashes the fields as a JSON object with the keys in the
+// given order, no whitespace and JSON.stringify string escaping, so browser
+// clients can produce the same bytes with JSON.stringify on an object literal.
+func canonicalBodyHash(fields [][2]string) string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		writeCanonicalString(&sb, field[0])
+		sb.WriteByte(':')
+		writeCanonicalString(&sb, field[1])
+	}
+	sb.WriteByte('}')
+
+	sum := sha256.Sum256([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeCanonicalString quotes s the way JSON.stringify does: only quotes,
+// backslashes and control characters are escaped, everything else is written
+// as UTF-8.
+func writeCanonicalString(sb *strings.Builder, s string) {
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(sb, `\u%04x`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+}
+
+// featureBodyHash is the canonical body hash of an update, over the editable
+// fields as sent.
+func featureBodyHash(feature *Feature) string {
+	return canonicalBodyHash([][2]string{
+		{"name", feature.Name},
+		{"description", feature.Description},
+		{"embedded_link", feature.EmbeddedLink},
+		{"color", feature.Color},
+		{"link_to_vr", feature.LinkToVR},
+	})
+}
+
+// restoreBodyHash is the canonical body hash of a restore of revision n.
+func restoreBodyHash(n uint64) string {
+	return canonicalBodyHash([][2]string{{"revision", fmt.Sprint(n)}})
+}
+
+// checkSignatureWindow rejects expired signatures and expiries further out
+// than maxSignatureLifetime, which bounds how long nonces must be kept.
+func checkSignatureWindow(signatureDto SignatureDto, now time.Time) error {
+	if len(signatureDto.Nonce) < minNonceLength || len(signatureDto.Nonce) > maxNonceLength {
+		return errInvalidNonce
+	}
+
+	expires := time.Unix(signatureDto.Expires, 0)
+	if !expires.After(now) {
+		return errSignatureExpired
+	}
+	if expires.After(now.Add(maxSignatureLifetime)) {
+		return errExpiryTooFar
+	}
+	return nil
+}
+
+// authorizeOwner checks that the request comes from the current owner of the
+// token and writes the error response when it does not. A bearer session
+// token is checked against the owner and the account keys as they are now, so
+// a transfer or a removed key ends it at once; without one, the request has to
+// carry an owner signature over the signed message with an unused nonce. It
+// returns the owner and the public key of the session or signature.
+func (fi *FeatureInterceptor) authorizeOwner(rw http.ResponseWriter, req *http.Request, signatureDto SignatureDto, action string, mergeId string, bodyHash string) (string, string, bool) {
+	if token, ok := bearerToken(req); ok {
+		session, err := findSession(fi.db, fi.nearInteractor, token)
+		if err == errInvalidSession {
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return "", "", false
+		}
+		if err != nil {
+			log.Printf("reading session: %v", err)
+			http.Error(rw, "could not verify session", http.StatusInternalServerError)
+			return "", "", false
+		}
+		owner, err := fi.nearInteractor.getOwnerByTokenId(mergeId)
+		if err != nil {
+			log.Printf("reading owner of %s: %v", mergeId, err)
+			http.Error(rw, "could not read token owner", http.StatusServiceUnavailable)
+			return "", "", false
+		}
+		if owner != session.AccountId {
+			rw.WriteHeader(http.StatusForbidden)
+			return "", "", false
+		}
+		return session.AccountId, session.PublicKey, true
+	}
+
+	if err := validator.New().Struct(signatureDto); err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+
+	if err := checkSignatureWindow(signatureDto, time.Now()); err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+
+	message, signature, err := fi.signedBytes(signatureDto, signedMessage(action, mergeId, bodyHash, signatureDto))
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+
+	owner, publicKey, isSignatureValid, err := fi.ValicateSignatureIsByTheOwner(signature, mergeId, message)
+	if err != nil {
+		log.Printf("reading owner of %s: %v", mergeId, err)
+		http.Error(rw, "could not read token owner", http.StatusServiceUnavailable)
+		return "", "", false
+	}
+	if !isSignatureValid {
+		rw.WriteHeader(http.StatusBadRequest)
+		return "", "", false
+	}
+
+	err = fi.consumeNonce(signatureDto, mergeId)
+	if err == errNonceUsed {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	if err != nil {
+		log.Printf("storing nonce for %s: %v", mergeId, err)
+		http.Error(rw, "could not verify signature", http.StatusInternalServerError)
+		return "", "", false
+	}
+	return owner, publicKey, true
+}
+
+// signedBytes returns the bytes the owner key signed and the signature for
+// the signature standard of the request. NEP-413 wallets sign the signed
+// message wrapped in their borsh payload and recipient is the master account.
+func (fi *FeatureInterceptor) signedBytes(signatureDto SignatureDto, message []byte) (SignedMessage, []byte, error) {
+	switch signatureDto.Standard {
+	case "":
+		signature, err := DecodeSignature(signatureDto.Signature, signatureDto.SignatureEncoding)
+		if err != nil {
+			return SignedMessage{}, nil, fmt.Errorf("decoding signature: %v", err)
+		}
+		return SignedMessage{Data: message}, signature, nil
+	case signatureStandardNEP413:
+		return nep413SignedBytes(signatureDto, message, fi.nearInteractor.MasterAccountId)
+	default:
+		return SignedMessage{}, nil, fmt.Errorf("unknown signature standard %q", signatureDto.Standard)
+	}
+}
+
+// consumeNonce records the nonce of a verified signature and returns
+// errNonceUsed when it was seen before. Nonces of expired signatures are
+// pruned on the way, since those signatures are rejected anyway.
+func (fi *FeatureInterceptor) consumeNonce(signatureDto SignatureDto, mergeId string) error {
+	now := time.Now()
+	if err := fi.db.Where("expires_at < ?", now).Delete(&SignatureNonce{}).Error; err != nil {
+		return err
+	}
+
+	nonce := SignatureNonce{Nonce: signatureDto.Nonce, MergeId: mergeId, ExpiresAt: time.Unix(signatureDto.Expires, 0)}
+	result := fi.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&nonce)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errNonceUsed
+	}
+	return nil
+}
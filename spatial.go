@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dhconnelly/rtreego"
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/planar"
+	"github.com/paulmach/orb/project"
+)
+
+const (
+	maxSpatialRadius  = 2000 // meters
+	maxSpatialResults = 100
+)
+
+// indexedFeature is a tile feature stitched across tiles and kept in web
+// mercator meters, so planar distances are true distances up to the mercator
+// scale factor of the latitude.
+type indexedFeature struct {
+	MergeId  string
+	Layer    string
+	Building bool
+	Geometry orb.Geometry
+	rect     rtreego.Rect
+}
+
+func (f *indexedFeature) Bounds() rtreego.Rect {
+	return f.rect
+}
+
+// SpatialIndex is an R-tree over the features of the tileset at a reference
+// zoom, keyed by merge_id. It answers point, radius, nearest and adjacency
+// queries without going to Elasticsearch.
+type SpatialIndex struct {
+	mu       sync.RWMutex
+	tree     *rtreego.Rtree
+	features map[string]*indexedFeature
+}
+
+type SpatialResult struct {
+	MergeId    string  `json:"merge_id"`
+	Layer      string  `json:"layer"`
+	IsBuilding bool    `json:"is_building"`
+	Distance   float64 `json:"distance"`
+}
+
+// Build reads every tile of zoom z and swaps the indexed features in. Until
+// the first build finishes, the handlers answer 503.
+func (index *SpatialIndex) Build(fi FeatureInterceptor, z uint8) error {
+	start := time.Now()
+	pieces := make(map[string][]orb.Geometry)
+	features := make(map[string]*indexedFeature)
+
+	err := fi.tiles.ForEachTile(func(tz uint8, x uint64, y uint64) error {
+		if tz != z {
+			return nil
+		}
+
+		layers, err := fi.tileLayersWGS84(tz, x, y)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range layers {
+			for _, f := range l.Features {
+				mergeId, ok := f.Properties["merge_id"].(string)
+				if !ok {
+					continue
+				}
+				if _, ok := features[mergeId]; !ok {
+					_, isBuilding := f.Properties["building"]
+					features[mergeId] = &indexedFeature{MergeId: mergeId, Layer: l.Name, Building: isBuilding}
+				}
+				pieces[mergeId] = append(pieces[mergeId], f.Geometry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	objects := make([]rtreego.Spatial, 0, len(features))
+	for mergeId, feature := range features {
+		// stitch in degrees, which the stitch tolerance is meant for
+		feature.Geometry = project.Geometry(stitchGeometries(pieces[mergeId]), project.WGS84.ToMercator)
+		feature.rect = boundToRect(feature.Geometry.Bound())
+		objects = append(objects, feature)
+	}
+
+	tree := rtreego.NewTree(2, 25, 50, objects...)
+
+	index.mu.Lock()
+	index.tree = tree
+	index.features = features
+	index.mu.Unlock()
+
+	log.Printf("spatial index: %d features at zoom %d in %s", len(objects), z, time.Since(start))
+	return nil
+}
+
+func (index *SpatialIndex) ready() bool {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	return index.tree != nil
+}
+
+func boundToRect(b orb.Bound) rtreego.Rect {
+	// rtreego rejects zero sized rectangles, which points and straight lines have
+	const epsilon = 1e-6
+	rect, _ := rtreego.NewRect(rtreego.Point{b.Min[0], b.Min[1]}, []float64{
+		math.Max(b.Max[0]-b.Min[0], epsilon),
+		math.Max(b.Max[1]-b.Min[1], epsilon),
+	})
+	return rect
+}
+
+// geometryDistance is zero inside polygons and the distance to the geometry
+// everywhere else, in the units of the geometry.
+func geometryDistance(g orb.Geometry, p orb.Point) float64 {
+	switch g := g.(type) {
+	case orb.Polygon:
+		if planar.PolygonContains(g, p) {
+			return 0
+		}
+	case orb.MultiPolygon:
+		if planar.MultiPolygonContains(g, p) {
+			return 0
+		}
+	}
+	return planar.DistanceFrom(g, p)
+}
+
+// geometriesDistance approximates the distance between two geometries by the
+// closest vertex of either one to the other.
+func geometriesDistance(a orb.Geometry, b orb.Geometry) float64 {
+	d := math.Inf(1)
+	for _, p := range geometryVertices(a) {
+		d = math.Min(d, geometryDistance(b, p))
+	}
+	for _, p := range geometryVertices(b) {
+		d = math.Min(d, geometryDistance(a, p))
+	}
+	return d
+}
+
+func geometryVertices(g orb.Geometry) []orb.Point {
+	points := make([]orb.Point, 0)
+	switch g := g.(type) {
+	case orb.Point:
+		points = append(points, g)
+	case orb.MultiPoint:
+		points = append(points, g...)
+	case orb.LineString:
+		points = append(points, g...)
+	case orb.MultiLineString:
+		for _, ls := range g {
+			points = append(points, ls...)
+		}
+	case orb.Polygon:
+		for _, r := range g {
+			points = append(points, r...)
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			for _, r := range p {
+				points = append(points, r...)
+			}
+		}
+	}
+	return points
+}
+
+// searchRadius returns the features within radius meters of the mercator
+// point p, nearest first. skip, when set, is left out of the results.
+func (index *SpatialIndex) searchRadius(p orb.Point, radius float64, distance func(*indexedFeature) float64, skip string) []SpatialResult {
+	scale := project.MercatorScaleFactor(project.Mercator.ToWGS84(p))
+	r := radius * scale
+	rect := boundToRect(orb.Bound{Min: orb.Point{p[0] - r, p[1] - r}, Max: orb.Point{p[0] + r, p[1] + r}})
+
+	results := make([]SpatialResult, 0)
+	for _, object := range index.tree.SearchIntersect(rect) {
+		feature := object.(*indexedFeature)
+		if feature.MergeId == skip {
+			continue
+		}
+		d := distance(feature) / scale
+		if d <= radius {
+			results = append(results, SpatialResult{MergeId: feature.MergeId, Layer: feature.Layer, IsBuilding: feature.Building, Distance: d})
+		}
+	}
+
+	sortSpatialResults(results)
+	if len(results) > maxSpatialResults {
+		results = results[:maxSpatialResults]
+	}
+	return results
+}
+
+func (index *SpatialIndex) At(p orb.Point) []SpatialResult {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	results := make([]SpatialResult, 0)
+	for _, result := range index.searchRadius(p, 0, func(f *indexedFeature) float64 { return geometryDistance(f.Geometry, p) }, "") {
+		if result.Distance == 0 {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+func (index *SpatialIndex) Within(p orb.Point, radius float64) []SpatialResult {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	return index.searchRadius(p, radius, func(f *indexedFeature) float64 { return geometryDistance(f.Geometry, p) }, "")
+}
+
+// NearestBuildings returns the k buildings closest to p. Near the antimeridian
+// the buildings on the far side of it are searched as well, from p shifted by
+// the width of the world.
+func (index *SpatialIndex) NearestBuildings(p orb.Point, k int) []SpatialResult {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	results := index.nearestBuildings(p, k)
+	if k <= 0 {
+		return results
+	}
+
+	scale := project.MercatorScaleFactor(project.Mercator.ToWGS84(p))
+	edge := mercatorHalfWidth - math.Abs(p[0])
+	if len(results) == k && results[k-1].Distance*scale <= edge {
+		return results
+	}
+
+	wrapped := orb.Point{p[0] - math.Copysign(2*mercatorHalfWidth, p[0]), p[1]}
+	byId := make(map[string]SpatialResult, len(results))
+	for _, result := range append(results, index.nearestBuildings(wrapped, k)...) {
+		if known, ok := byId[result.MergeId]; !ok || result.Distance < known.Distance {
+			byId[result.MergeId] = result
+		}
+	}
+
+	results = results[:0]
+	for _, result := range byId {
+		results = append(results, result)
+	}
+	sortSpatialResults(results)
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+// mercatorHalfWidth is the web mercator x of the antimeridian.
+var mercatorHalfWidth = project.WGS84.ToMercator(orb.Point{180, 0})[0]
+
+// nearestBuildings ranks the buildings around p. Candidates come from the
+// R-tree in order of their bounding box distance, which never exceeds the real
+// one, so more are fetched until the next candidate's box is farther away than
+// the k-th closest building found, and no building tied with it is missed.
+func (index *SpatialIndex) nearestBuildings(p orb.Point, k int) []SpatialResult {
+	onlyBuildings := func(_ []rtreego.Spatial, object rtreego.Spatial) (bool, bool) {
+		return !object.(*indexedFeature).Building, false
+	}
+
+	results := make([]SpatialResult, 0, k)
+	if k <= 0 {
+		return results
+	}
+
+	scale := project.MercatorScaleFactor(project.Mercator.ToWGS84(p))
+	for n := k; ; n *= 2 {
+		candidates := index.tree.NearestNeighbors(n, rtreego.Point{p[0], p[1]}, onlyBuildings)
+
+		results = results[:0]
+		var farthest float64
+		for _, object := range candidates {
+			if object == nil {
+				continue
+			}
+			feature := object.(*indexedFeature)
+			farthest = rectDistance(feature.rect, p)
+			results = append(results, SpatialResult{
+				MergeId:    feature.MergeId,
+				Layer:      feature.Layer,
+				IsBuilding: true,
+				Distance:   geometryDistance(feature.Geometry, p) / scale,
+			})
+		}
+		sortSpatialResults(results)
+
+		// fewer candidates than asked for means every building was ranked
+		if len(results) < n || (len(results) >= k && farthest/scale > results[k-1].Distance) {
+			break
+		}
+	}
+
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+// sortSpatialResults orders the results nearest first, and equally distant
+// ones by merge_id so that ties are cut the same way on every request.
+func sortSpatialResults(results []SpatialResult) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Distance != results[j].Distance {
+			return results[i].Distance < results[j].Distance
+		}
+		return results[i].MergeId < results[j].MergeId
+	})
+}
+
+// rectDistance is the distance from p to the closest point of the rect.
+func rectDistance(r rtreego.Rect, p orb.Point) float64 {
+	d := 0.0
+	for i := 0; i < 2; i++ {
+		min, max := r.PointCoord(i), r.PointCoord(i)+r.LengthsCoord(i)
+		if p[i] < min {
+			d += (min - p[i]) * (min - p[i])
+		} else if p[i] > max {
+			d += (p[i] - max) * (p[i] - max)
+		}
+	}
+	return math.Sqrt(d)
+}
+
+// Neighbors returns the features within distance meters of the feature's
+// outline, or false when the merge_id is not indexed.
+func (index *SpatialIndex) Neighbors(mergeId string, distance float64) ([]SpatialResult, bool) {
+	index.mu.RLock()
+	defer index.mu.RUnlock()
+
+	feature, ok := index.features[mergeId]
+	if !ok {
+		return nil, false
+	}
+
+	bound := feature.Geometry.Bound()
+	center := bound.Center()
+	// widen the search so it covers the whole feature plus the distance
+	radius := math.Max(bound.Max[0]-bound.Min[0], bound.Max[1]-bound.Min[1]) / project.MercatorScaleFactor(project.Mercator.ToWGS84(center))
+
+	results := make([]SpatialResult, 0)
+	for _, result := range index.searchRadius(center, radius+distance, func(f *indexedFeature) float64 { return geometriesDistance(f.Geometry, feature.Geometry) }, mergeId) {
+		if result.Distance <= distance {
+			results = append(results, result)
+		}
+	}
+	return results, true
+}
+
+func spatialPoint(req *http.Request) (orb.Point, error) {
+	query := req.URL.Query()
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil || lat < -85 || lat > 85 {
+		return orb.Point{}, fmt.Errorf("invalid lat %q", query.Get("lat"))
+	}
+	long, err := strconv.ParseFloat(query.Get("long"), 64)
+	if err != nil || long < -180 || long > 180 {
+		return orb.Point{}, fmt.Errorf("invalid long %q", query.Get("long"))
+	}
+	return project.WGS84.ToMercator(orb.Point{long, lat}), nil
+}
+
+func spatialNumber(req *http.Request, name string, fallback float64, max float64) (float64, error) {
+	param := req.URL.Query().Get(name)
+	if param == "" {
+		return fallback, nil
+	}
+	v, err := strconv.ParseFloat(param, 64)
+	if err != nil || v < 0 || v > max {
+		return 0, fmt.Errorf("%s must be between 0 and %g", name, max)
+	}
+	return v, nil
+}
+
+func writeSpatialResults(rw http.ResponseWriter, results []SpatialResult) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(&results)
+	rw.Write(body)
+}
+
+func (index *SpatialIndex) HandleAt(rw http.ResponseWriter, req *http.Request) {
+	if !index.ready() {
+		http.Error(rw, "spatial index is being built", http.StatusServiceUnavailable)
+		return
+	}
+
+	p, err := spatialPoint(req)
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeSpatialResults(rw, index.At(p))
+}
+
+func (index *SpatialIndex) HandleWithin(rw http.ResponseWriter, req *http.Request) {
+	if !index.ready() {
+		http.Error(rw, "spatial index is being built", http.StatusServiceUnavailable)
+		return
+	}
+
+	p, err := spatialPoint(req)
+	if err == nil {
+		var radius float64
+		radius, err = spatialNumber(req, "radius", 100, maxSpatialRadius)
+		if err == nil {
+			writeSpatialResults(rw, index.Within(p, radius))
+			return
+		}
+	}
+	http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+}
+
+func (index *SpatialIndex) HandleNearest(rw http.ResponseWriter, req *http.Request) {
+	if !index.ready() {
+		http.Error(rw, "spatial index is being built", http.StatusServiceUnavailable)
+		return
+	}
+
+	p, err := spatialPoint(req)
+	if err == nil {
+		var k float64
+		k, err = spatialNumber(req, "k", 10, maxSpatialResults)
+		if err == nil {
+			writeSpatialResults(rw, index.NearestBuildings(p, int(k)))
+			return
+		}
+	}
+	http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+}
+
+func (index *SpatialIndex) HandleNeighbors(rw http.ResponseWriter, req *http.Request) {
+	if !index.ready() {
+		http.Error(rw, "spatial index is being built", http.StatusServiceUnavailable)
+		return
+	}
+
+	distance, err := spatialNumber(req, "distance", 5, maxSpatialRadius)
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results, found := index.Neighbors(mux.Vars(req)["mergeId"], distance)
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeSpatialResults(rw, results)
+}
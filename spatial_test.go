@@ -0,0 +1,155 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dhconnelly/rtreego"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/project"
+)
+
+// testBuilding is a square building of the given side in meters, centered on
+// the WGS84 point.
+func testBuilding(mergeId string, lon, lat float64, side float64) *indexedFeature {
+	center := project.WGS84.ToMercator(orb.Point{lon, lat})
+	half := side / 2 * project.MercatorScaleFactor(orb.Point{lon, lat})
+	return &indexedFeature{
+		MergeId:  mergeId,
+		Layer:    "building",
+		Building: true,
+		Geometry: orb.Polygon{{
+			{center[0] - half, center[1] - half},
+			{center[0] + half, center[1] - half},
+			{center[0] + half, center[1] + half},
+			{center[0] - half, center[1] + half},
+			{center[0] - half, center[1] - half},
+		}},
+	}
+}
+
+func newTestIndex(features ...*indexedFeature) *SpatialIndex {
+	index := &SpatialIndex{features: make(map[string]*indexedFeature)}
+	objects := make([]rtreego.Spatial, 0, len(features))
+	for _, feature := range features {
+		feature.rect = boundToRect(feature.Geometry.Bound())
+		index.features[feature.MergeId] = feature
+		objects = append(objects, feature)
+	}
+	index.tree = rtreego.NewTree(2, 25, 50, objects...)
+	return index
+}
+
+// mercatorSquare is a square building of the given side around the mercator
+// point; at the equator mercator units are meters.
+func mercatorSquare(mergeId string, x, y float64, side float64) *indexedFeature {
+	half := side / 2
+	return &indexedFeature{
+		MergeId:  mergeId,
+		Layer:    "building",
+		Building: true,
+		Geometry: orb.Polygon{{
+			{x - half, y - half},
+			{x + half, y - half},
+			{x + half, y + half},
+			{x - half, y + half},
+			{x - half, y - half},
+		}},
+	}
+}
+
+func TestNearestBuildings(t *testing.T) {
+	road := mercatorSquare("road", 0, 0, 10)
+	road.Building, road.Layer = false, "transportation"
+
+	// north, east and west are exactly 15 meters from the origin
+	index := newTestIndex(
+		road,
+		mercatorSquare("west", -20, 0, 10),
+		mercatorSquare("north", 0, 20, 10),
+		mercatorSquare("east", 20, 0, 10),
+		mercatorSquare("far", 300, 0, 10),
+	)
+
+	tests := []struct {
+		name string
+		k    int
+		want []string
+	}{
+		{"no buildings asked for", 0, []string{}},
+		{"ties at the k-th distance are cut by merge_id", 1, []string{"east"}},
+		{"ties past k", 2, []string{"east", "north"}},
+		{"k larger than the candidates", 10, []string{"east", "north", "west", "far"}},
+	}
+
+	for _, test := range tests {
+		got := index.NearestBuildings(orb.Point{0, 0}, test.k)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i].MergeId != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+
+	results := index.NearestBuildings(orb.Point{0, 0}, 1)
+	if results[0].Distance != 15 {
+		t.Errorf("distance %g, want 15 meters", results[0].Distance)
+	}
+}
+
+func TestNearestBuildingsBoxCloserThanOutline(t *testing.T) {
+	p := project.WGS84.ToMercator(orb.Point{-79.3832, 43.6532})
+	scale := project.MercatorScaleFactor(orb.Point{-79.3832, 43.6532})
+
+	// a thin diagonal building whose bounding box holds p, 35 meters away;
+	// the other building is 25 meters away
+	diagonal := &indexedFeature{MergeId: "diagonal", Layer: "building", Building: true, Geometry: orb.Polygon{{
+		{p[0] - 50*scale, p[1] - 100*scale},
+		{p[0] + 250*scale, p[1] + 200*scale},
+		{p[0] + 250*scale, p[1] + 199*scale},
+		{p[0] - 50*scale, p[1] - 100*scale},
+	}}}
+	near := testBuilding("near", -79.3832, 43.6532+30/111320.0, 10)
+
+	index := newTestIndex(diagonal, near)
+	results := index.NearestBuildings(p, 1)
+	if len(results) != 1 || results[0].MergeId != "near" {
+		t.Errorf("got %v, want near", results)
+	}
+}
+
+func TestNearestBuildingsEmptyIndex(t *testing.T) {
+	index := newTestIndex()
+	results := index.NearestBuildings(orb.Point{0, 0}, 5)
+	if results == nil || len(results) != 0 {
+		t.Errorf("got %v, want no results", results)
+	}
+}
+
+func TestNearestBuildingsAntimeridian(t *testing.T) {
+	// both buildings are about 20 meters from the query point, on either
+	// side of the antimeridian
+	index := newTestIndex(
+		testBuilding("west", 179.9996, 0, 10),
+		testBuilding("east", -179.9996, 0, 10),
+		testBuilding("far", -179.99, 0, 10),
+	)
+
+	for _, lon := range []float64{179.99999, -179.99999} {
+		p := project.WGS84.ToMercator(orb.Point{lon, 0})
+		results := index.NearestBuildings(p, 2)
+		if len(results) != 2 || results[0].MergeId == "far" || results[1].MergeId == "far" {
+			t.Errorf("at %g: got %v, want east and west", lon, results)
+			continue
+		}
+		for _, result := range results {
+			if result.Distance > 50 {
+				t.Errorf("at %g: %s is %g meters away, want less than 50", lon, result.MergeId, result.Distance)
+			}
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/clip"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/planar"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+const (
+	maxStaticSize  = 1280
+	staticTileSize = 256
+	staticPadding  = 0.15 // share of the image left around a feature
+)
+
+var staticLabelFace font.Face
+
+func init() {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		panic(err)
+	}
+	staticLabelFace, err = opentype.NewFace(f, &opentype.FaceOptions{Size: 12, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// staticView places the map on the image: world pixel coordinates at a
+// fractional zoom, with the image's top left corner at origin.
+type staticView struct {
+	zoom          float64
+	origin        orb.Point
+	width, height int
+}
+
+func newStaticView(center orb.Point, zoom float64, width int, height int) staticView {
+	c := worldPixel(center, zoom)
+	return staticView{
+		zoom:   zoom,
+		origin: orb.Point{c[0] - float64(width)/2, c[1] - float64(height)/2},
+		width:  width,
+		height: height,
+	}
+}
+
+// worldPixel is the position of a WGS84 point on a 256px tile grid at zoom.
+func worldPixel(p orb.Point, zoom float64) orb.Point {
+	f := maptile.Fraction(p, 0)
+	scale := staticTileSize * math.Pow(2, zoom)
+	return orb.Point{f[0] * scale, f[1] * scale}
+}
+
+// StaticMap renders tile data around center into a PNG-ready image. Features
+// get the overlay of GetTile, so owner colors and custom names show up;
+// the highlighted merge_id, if any, is outlined.
+func (fi FeatureInterceptor) StaticMap(center orb.Point, zoom float64, width int, height int, theme styleTheme, highlight string) (*image.RGBA, error) {
+	view := newStaticView(center, zoom, width, height)
+
+	minZoom, maxZoom := fi.tiles.ZoomRange()
+	tz := uint8(math.Max(float64(minZoom), math.Min(float64(maxZoom), math.Floor(zoom))))
+	tilesPerWorld := float64(uint64(1) << tz)
+	worldSize := staticTileSize * math.Pow(2, zoom)
+	tileSize := worldSize / tilesPerWorld
+
+	minX := int64(math.Floor(view.origin[0] / tileSize))
+	minY := int64(math.Floor(view.origin[1] / tileSize))
+	maxX := int64(math.Floor((view.origin[0] + float64(width)) / tileSize))
+	maxY := int64(math.Floor((view.origin[1] + float64(height)) / tileSize))
+	if (maxX-minX+1)*(maxY-minY+1) > maxGeometryTiles {
+		return nil, errTooManyTiles
+	}
+
+	var areas, lines, buildings, highlighted []orb.Geometry
+	var buildingColors []color.Color
+	labels := make([]*geojson.Feature, 0)
+
+	for tx := minX; tx <= maxX; tx++ {
+		for ty := minY; ty <= maxY; ty++ {
+			if ty < 0 || ty >= int64(tilesPerWorld) {
+				continue
+			}
+			// wrap around the antimeridian
+			x := uint64((tx%int64(tilesPerWorld) + int64(tilesPerWorld)) % int64(tilesPerWorld))
+
+			data, err := fi.cachedTile(tz, x, uint64(ty), tileFilter{})
+			if err != nil {
+				return nil, err
+			}
+			if data == nil {
+				continue
+			}
+
+			layers, err := mvt.UnmarshalGzipped(data)
+			if err != nil {
+				return nil, fmt.Errorf("decoding tile: %v", err)
+			}
+
+			offset := orb.Point{float64(tx)*tileSize - view.origin[0], float64(ty)*tileSize - view.origin[1]}
+			for _, l := range layers {
+				scale := tileSize / float64(l.Extent)
+				for _, f := range l.Features {
+					g := clip.Geometry(orb.Bound{Min: orb.Point{-2, -2}, Max: orb.Point{float64(width) + 2, float64(height) + 2}},
+						projectGeometry(f.Geometry, func(p orb.Point) orb.Point {
+							return orb.Point{p[0]*scale + offset[0], p[1]*scale + offset[1]}
+						}))
+					if g == nil {
+						continue
+					}
+
+					_, isBuilding := f.Properties["building"]
+					switch {
+					case g.Dimensions() == 2 && isBuilding:
+						buildings = append(buildings, g)
+						buildingColors = append(buildingColors, parseHexColor(f.Properties["color"], theme.Building))
+					case g.Dimensions() == 2:
+						areas = append(areas, g)
+					case g.Dimensions() == 1:
+						lines = append(lines, g)
+					}
+
+					if mergeId, _ := f.Properties["merge_id"].(string); highlight != "" && mergeId == highlight {
+						highlighted = append(highlighted, g)
+					}
+					if _, customName := f.Properties["osm_name"]; customName && g.Dimensions() == 2 {
+						labels = append(labels, geojson.NewFeature(g))
+						labels[len(labels)-1].Properties = f.Properties
+					}
+				}
+			}
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(parseHexColor(theme.Background, "#FFFFFF")), image.Point{}, draw.Src)
+
+	fillGeometries(img, areas, parseHexColor(theme.Area, theme.Background))
+	strokeGeometries(img, lines, parseHexColor(theme.Road, theme.Background), 2)
+	for i, g := range buildings {
+		fillGeometries(img, []orb.Geometry{g}, buildingColors[i])
+	}
+	strokeGeometries(img, highlighted, parseHexColor(theme.CustomText, theme.Text), 3)
+
+	for _, label := range labels {
+		name, _ := label.Properties["name"].(string)
+		center, _ := planar.CentroidArea(label.Geometry)
+		drawLabel(img, name, center, parseHexColor(theme.CustomText, theme.Text), parseHexColor(theme.TextHalo, theme.Background))
+	}
+
+	return img, nil
+}
+
+// projectGeometry applies project to every point of a cloned geometry.
+func projectGeometry(g orb.Geometry, project func(orb.Point) orb.Point) orb.Geometry {
+	g = orb.Clone(g)
+	transform := func(ps []orb.Point) {
+		for i := range ps {
+			ps[i] = project(ps[i])
+		}
+	}
+
+	switch g := g.(type) {
+	case orb.Point:
+		return project(g)
+	case orb.MultiPoint:
+		transform(g)
+	case orb.LineString:
+		transform(g)
+	case orb.MultiLineString:
+		for _, ls := range g {
+			transform(ls)
+		}
+	case orb.Polygon:
+		for _, r := range g {
+			transform(r)
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			for _, r := range p {
+				transform(r)
+			}
+		}
+	}
+	return g
+}
+
+func fillGeometries(img *image.RGBA, geometries []orb.Geometry, c color.Color) {
+	if len(geometries) == 0 {
+		return
+	}
+
+	z := vector.NewRasterizer(img.Bounds().Dx(), img.Bounds().Dy())
+	addRing := func(r orb.Ring) {
+		if len(r) < 3 {
+			return
+		}
+		z.MoveTo(float32(r[0][0]), float32(r[0][1]))
+		for _, p := range r[1:] {
+			z.LineTo(float32(p[0]), float32(p[1]))
+		}
+		z.ClosePath()
+	}
+
+	for _, g := range geometries {
+		switch g := g.(type) {
+		case orb.Polygon:
+			for _, r := range g {
+				addRing(r)
+			}
+		case orb.MultiPolygon:
+			for _, p := range g {
+				for _, r := range p {
+					addRing(r)
+				}
+			}
+		}
+	}
+	z.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{})
+}
+
+// strokeGeometries draws lines and polygon outlines as one quad per segment.
+// All quads share the same winding, so overlaps at joints do not cancel out.
+func strokeGeometries(img *image.RGBA, geometries []orb.Geometry, c color.Color, width float64) {
+	if len(geometries) == 0 {
+		return
+	}
+
+	z := vector.NewRasterizer(img.Bounds().Dx(), img.Bounds().Dy())
+	addLine := func(ls []orb.Point) {
+		for i := 1; i < len(ls); i++ {
+			a, b := ls[i-1], ls[i]
+			length := math.Hypot(b[0]-a[0], b[1]-a[1])
+			if length == 0 {
+				continue
+			}
+			nx, ny := -(b[1]-a[1])/length*width/2, (b[0]-a[0])/length*width/2
+			z.MoveTo(float32(a[0]+nx), float32(a[1]+ny))
+			z.LineTo(float32(b[0]+nx), float32(b[1]+ny))
+			z.LineTo(float32(b[0]-nx), float32(b[1]-ny))
+			z.LineTo(float32(a[0]-nx), float32(a[1]-ny))
+			z.ClosePath()
+		}
+	}
+
+	for _, g := range geometries {
+		switch g := g.(type) {
+		case orb.LineString:
+			addLine(g)
+		case orb.MultiLineString:
+			for _, ls := range g {
+				addLine(ls)
+			}
+		case orb.Polygon:
+			for _, r := range g {
+				addLine(r)
+			}
+		case orb.MultiPolygon:
+			for _, p := range g {
+				for _, r := range p {
+					addLine(r)
+				}
+			}
+		}
+	}
+	z.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{})
+}
+
+// drawLabel writes text centered on p with a one pixel halo.
+func drawLabel(img *image.RGBA, text string, p orb.Point, textColor color.Color, haloColor color.Color) {
+	if text == "" {
+		return
+	}
+
+	d := &font.Drawer{Dst: img, Face: staticLabelFace}
+	width := d.MeasureString(text)
+	metrics := staticLabelFace.Metrics()
+	origin := fixed.Point26_6{
+		X: fixed.Int26_6(p[0]*64) - width/2,
+		Y: fixed.Int26_6(p[1]*64) + (metrics.Ascent-metrics.Descent)/2,
+	}
+
+	d.Src = image.NewUniform(haloColor)
+	for _, o := range [][2]fixed.Int26_6{{-64, 0}, {64, 0}, {0, -64}, {0, 64}} {
+		d.Dot = fixed.Point26_6{X: origin.X + o[0], Y: origin.Y + o[1]}
+		d.DrawString(text)
+	}
+
+	d.Src = image.NewUniform(textColor)
+	d.Dot = origin
+	d.DrawString(text)
+}
+
+// parseHexColor reads a "#RRGGBB" color property, falling back to the theme
+// color when the value is missing or malformed.
+func parseHexColor(value interface{}, fallback string) color.Color {
+	parse := func(s string) (color.Color, bool) {
+		var r, g, b uint8
+		if len(s) != 7 {
+			return nil, false
+		}
+		if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err != nil {
+			return nil, false
+		}
+		return color.RGBA{R: r, G: g, B: b, A: 0xff}, true
+	}
+
+	if s, ok := value.(string); ok {
+		if c, ok := parse(s); ok {
+			return c
+		}
+	}
+	if c, ok := parse(fallback); ok {
+		return c
+	}
+	return color.Black
+}
+
+// staticSize reads the {w}x{h} route variables.
+func staticSize(vars map[string]string) (int, int, error) {
+	width, errW := strconv.Atoi(vars["w"])
+	height, errH := strconv.Atoi(vars["h"])
+	if errW != nil || errH != nil || width <= 0 || height <= 0 || width > maxStaticSize || height > maxStaticSize {
+		return 0, 0, fmt.Errorf("size must be between 1x1 and %dx%d", maxStaticSize, maxStaticSize)
+	}
+	return width, height, nil
+}
+
+func staticTheme(req *http.Request) (styleTheme, error) {
+	name := req.URL.Query().Get("style")
+	if name == "" {
+		name = "light"
+	}
+	theme, ok := styleThemes[name]
+	if !ok {
+		return styleTheme{}, fmt.Errorf("unknown style %q", name)
+	}
+	return theme, nil
+}
+
+func (fi FeatureInterceptor) writeStaticMap(rw http.ResponseWriter, center orb.Point, zoom float64, width int, height int, theme styleTheme, highlight string) {
+	img, err := fi.StaticMap(center, zoom, width, height, theme, highlight)
+	if err == errTooManyTiles {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("static map at %v/%g: %v", center, zoom, err)
+		http.Error(rw, "could not render map", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "image/png")
+	rw.WriteHeader(http.StatusOK)
+	png.Encode(rw, img)
+}
+
+// GetStaticMap serves /static/{lon},{lat},{zoom}/{w}x{h}.png
+func (fi FeatureInterceptor) GetStaticMap(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	lon, errLon := strconv.ParseFloat(vars["lon"], 64)
+	lat, errLat := strconv.ParseFloat(vars["lat"], 64)
+	zoom, errZoom := strconv.ParseFloat(vars["zoom"], 64)
+	if errLon != nil || errLat != nil || errZoom != nil || lon < -180 || lon > 180 || lat < -85 || lat > 85 {
+		http.Error(rw, "Request Error invalid center or zoom", http.StatusBadRequest)
+		return
+	}
+
+	// below the tileset min zoom every image pixel would need a stored tile
+	minZoom, maxZoom := fi.servedZoomRange()
+	if zoom < float64(minZoom) || zoom > float64(maxZoom) {
+		http.Error(rw, fmt.Sprintf("Request Error zoom must be between %d and %d", minZoom, maxZoom), http.StatusBadRequest)
+		return
+	}
+
+	width, height, err := staticSize(vars)
+	if err == nil {
+		var theme styleTheme
+		theme, err = staticTheme(req)
+		if err == nil {
+			fi.writeStaticMap(rw, orb.Point{lon, lat}, zoom, width, height, theme, "")
+			return
+		}
+	}
+	http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+}
+
+// GetFeatureStaticMap serves /static/features/{mergeId}/{w}x{h}.png, framing
+// the feature's bounding box and outlining the feature.
+func (fi FeatureInterceptor) GetFeatureStaticMap(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	mergeId := vars["mergeId"]
+
+	width, height, err := staticSize(vars)
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	theme, err := staticTheme(req)
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	elasticElement, found := fi.s.getElasticElement(mergeId)
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	center, zoom := fi.fitBound(elementBound(elasticElement), width, height)
+	fi.writeStaticMap(rw, center, zoom, width, height, theme, mergeId)
+}
+
+// fitBound returns the center and zoom showing the bound with some padding,
+// within the served zoom range. Features too large for the tileset min zoom
+// are cut off rather than read from more tiles.
+func (fi FeatureInterceptor) fitBound(bound orb.Bound, width int, height int) (orb.Point, float64) {
+	minZoom, maxZoom := fi.servedZoomRange()
+
+	min, max := worldPixel(orb.Point{bound.Min[0], bound.Max[1]}, 0), worldPixel(orb.Point{bound.Max[0], bound.Min[1]}, 0)
+	spanX := math.Max(max[0]-min[0], 1e-9)
+	spanY := math.Max(max[1]-min[1], 1e-9)
+
+	usable := 1 - 2*staticPadding
+	zoom := math.Min(math.Log2(float64(width)*usable/spanX), math.Log2(float64(height)*usable/spanY))
+	zoom = math.Max(float64(minZoom), math.Min(float64(maxZoom), zoom))
+
+	return bound.Center(), zoom
+}
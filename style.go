@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// styleTheme holds the base colors of a style variant. Owner colors from
+// featureColorPalette are drawn on top of it unchanged.
+type styleTheme struct {
+	Background   string
+	Area         string
+	Building     string
+	BuildingLine string
+	Road         string
+	Text         string
+	TextHalo     string
+	CustomText   string
+}
+
+var styleThemes = map[string]styleTheme{
+	"light": {
+		Background:   "#F8F4F0",
+		Area:         "#E8E4DE",
+		Building:     "#D9D0C9",
+		BuildingLine: "#BFB5AC",
+		Road:         "#FFFFFF",
+		Text:         "#404040",
+		TextHalo:     "#FFFFFF",
+		CustomText:   "#0047FF",
+	},
+	"dark": {
+		Background:   "#101010",
+		Area:         "#1C1C1C",
+		Building:     "#303030",
+		BuildingLine: "#404040",
+		Road:         "#505050",
+		Text:         "#BDBDBD",
+		TextHalo:     "#101010",
+		CustomText:   "#57C8FF",
+	},
+}
+
+const styleSourceName = "shizo"
+
+// GetStyle serves a MapLibre / Mapbox GL style for the tileset, with owner
+// colors and custom names from the tile overlay wired into the layers.
+func (fi FeatureInterceptor) GetStyle(rw http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+
+	theme, ok := styleThemes[name]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	metadata, err := fi.tiles.Metadata()
+	if err != nil {
+		log.Printf("reading tileset metadata: %v", err)
+		http.Error(rw, "could not read tileset metadata", http.StatusInternalServerError)
+		return
+	}
+
+	minZoom, maxZoom := fi.tiles.ZoomRange()
+	source := map[string]interface{}{
+		"type":    "vector",
+		"tiles":   []string{requestBaseURL(req) + "/tiles/{z}/{x}/{y}"},
+		"minzoom": minZoom,
+		"maxzoom": maxZoom,
+	}
+	if bounds, ok := parseBounds(metadata["bounds"]); ok {
+		source["bounds"] = bounds
+	}
+
+	layers := styleLayers(theme, vectorLayerIds(metadata))
+	if fi.clusters != nil {
+		layers = append(layers, clusterStyleLayers(theme, fi.clusterMaxZoom)...)
+	}
+
+	style := map[string]interface{}{
+		"version": 8,
+		"name":    "shizo-" + name,
+		"metadata": map[string]interface{}{
+			"shizo:variant": name,
+			"shizo:palette": featureColorPalette,
+		},
+		"sources": map[string]interface{}{styleSourceName: source},
+		"glyphs":  fi.glyphsURL,
+		"layers":  layers,
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(style)
+	rw.Write(body)
+}
+
+// featureColorExpression colors a feature with its owner color when it is one
+// of the palette colors, and with fallback otherwise.
+func featureColorExpression(fallback string) []interface{} {
+	return []interface{}{
+		"match", []interface{}{"get", "color"},
+		featureColorPalette, []interface{}{"to-color", []interface{}{"get", "color"}},
+		fallback,
+	}
+}
+
+func styleLayers(theme styleTheme, sourceLayers []string) []interface{} {
+	isPolygon := []interface{}{"==", []interface{}{"geometry-type"}, "Polygon"}
+	isLine := []interface{}{"==", []interface{}{"geometry-type"}, "LineString"}
+	// GetTile stores the original name in osm_name whenever an owner renamed the feature
+	hasCustomName := []interface{}{"has", "osm_name"}
+
+	layers := []interface{}{
+		map[string]interface{}{
+			"id":    "background",
+			"type":  "background",
+			"paint": map[string]interface{}{"background-color": theme.Background},
+		},
+	}
+
+	labels := make([]interface{}, 0)
+
+	for _, sourceLayer := range sourceLayers {
+		if strings.Contains(sourceLayer, "building") {
+			layers = append(layers, map[string]interface{}{
+				"id":           sourceLayer + "-fill",
+				"type":         "fill",
+				"source":       styleSourceName,
+				"source-layer": sourceLayer,
+				"filter":       isPolygon,
+				"paint": map[string]interface{}{
+					"fill-color":         featureColorExpression(theme.Building),
+					"fill-outline-color": theme.BuildingLine,
+				},
+			})
+		} else {
+			layers = append(layers, map[string]interface{}{
+				"id":           sourceLayer + "-fill",
+				"type":         "fill",
+				"source":       styleSourceName,
+				"source-layer": sourceLayer,
+				"filter":       isPolygon,
+				"paint":        map[string]interface{}{"fill-color": theme.Area},
+			}, map[string]interface{}{
+				"id":           sourceLayer + "-line",
+				"type":         "line",
+				"source":       styleSourceName,
+				"source-layer": sourceLayer,
+				"filter":       isLine,
+				"paint":        map[string]interface{}{"line-color": theme.Road, "line-width": 2},
+			})
+		}
+
+		labels = append(labels, map[string]interface{}{
+			"id":           sourceLayer + "-label",
+			"type":         "symbol",
+			"source":       styleSourceName,
+			"source-layer": sourceLayer,
+			"filter":       []interface{}{"all", []interface{}{"has", "name"}, []interface{}{"!", hasCustomName}},
+			"layout": map[string]interface{}{
+				"text-field": []interface{}{"get", "name"},
+				"text-font":  []string{"Open Sans Regular"},
+				"text-size":  12,
+			},
+			"paint": map[string]interface{}{
+				"text-color":      theme.Text,
+				"text-halo-color": theme.TextHalo,
+				"text-halo-width": 1,
+			},
+		}, map[string]interface{}{
+			"id":           sourceLayer + "-custom-label",
+			"type":         "symbol",
+			"source":       styleSourceName,
+			"source-layer": sourceLayer,
+			"filter":       hasCustomName,
+			"layout": map[string]interface{}{
+				// custom name first, the original name below it when there is one
+				"text-field": []interface{}{
+					"case", []interface{}{"==", []interface{}{"get", "osm_name"}, ""},
+					[]interface{}{"get", "name"},
+					[]interface{}{
+						"format",
+						[]interface{}{"get", "name"}, map[string]interface{}{},
+						"\n", map[string]interface{}{},
+						[]interface{}{"get", "osm_name"}, map[string]interface{}{"font-scale": 0.8},
+					},
+				},
+				"text-font": []string{"Open Sans Bold"},
+				"text-size": 13,
+			},
+			"paint": map[string]interface{}{
+				"text-color":      theme.CustomText,
+				"text-halo-color": theme.TextHalo,
+				"text-halo-width": 1.5,
+			},
+		})
+	}
+
+	// labels go last so they are drawn above every fill and line
+	return append(layers, labels...)
+}
+
+// parseBounds reads the "w,s,e,n" bounds of the tileset metadata, which is a
+// string in MBTiles and may be an array in PMTiles.
+func parseBounds(bounds interface{}) ([]float64, bool) {
+	switch b := bounds.(type) {
+	case string:
+		var w, s, e, n float64
+		if _, err := fmt.Sscanf(b, "%g,%g,%g,%g", &w, &s, &e, &n); err != nil {
+			return nil, false
+		}
+		return []float64{w, s, e, n}, true
+	case []interface{}:
+		out := make([]float64, 0, 4)
+		for _, v := range b {
+			f, ok := v.(float64)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, f)
+		}
+		return out, len(out) == 4
+	}
+	return nil, false
+}
+
+func requestBaseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + req.Host
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/clip"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+)
+
+const (
+	// svgSurroundings is the share of the feature size shown around it, with
+	// svgMinSurroundings degrees at least so small features still get context.
+	svgSurroundings    = 0.5
+	svgMinSurroundings = 0.0005
+
+	// svgSize is the length of the longer side of the document
+	svgSize = 512.0
+)
+
+// FeatureSVG draws the feature with the buildings and roads around it as an
+// SVG document. Surrounding features get the same overlay as GetTile and the
+// same styling as GetStyle, so owner colors and custom labels match the map.
+func (fi FeatureInterceptor) FeatureSVG(mergeId string, bound orb.Bound, z uint8, theme styleTheme) ([]byte, bool, error) {
+	padX := math.Max((bound.Max[0]-bound.Min[0])*svgSurroundings, svgMinSurroundings)
+	padY := math.Max((bound.Max[1]-bound.Min[1])*svgSurroundings, svgMinSurroundings)
+	view := orb.Bound{
+		Min: orb.Point{bound.Min[0] - padX, bound.Min[1] - padY},
+		Max: orb.Point{bound.Max[0] + padX, bound.Max[1] + padY},
+	}
+
+	// group by source layer so overlayTile can load the Feature rows in one query
+	layersByName := make(map[string]*mvt.Layer)
+	layers := make(mvt.Layers, 0)
+	pieces := make([]orb.Geometry, 0)
+
+	err := fi.forEachTileFeature(view, z, func(layer string, f *geojson.Feature) {
+		f.Geometry = clip.Geometry(view, f.Geometry)
+		if f.Geometry == nil {
+			return
+		}
+		if id, _ := f.Properties["merge_id"].(string); id == mergeId {
+			pieces = append(pieces, f.Geometry)
+		}
+
+		l, ok := layersByName[layer]
+		if !ok {
+			l = &mvt.Layer{Name: layer}
+			layersByName[layer] = l
+			layers = append(layers, l)
+		}
+		l.Features = append(l.Features, f)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(pieces) == 0 {
+		return nil, false, nil
+	}
+
+	for _, id := range tileMergeIds(layers) {
+		if fi.customized.has(id) {
+			if err := fi.overlayTile(layers); err != nil {
+				return nil, false, err
+			}
+			break
+		}
+	}
+
+	origin := worldPixel(orb.Point{view.Min[0], view.Max[1]}, float64(z))
+	corner := worldPixel(orb.Point{view.Max[0], view.Min[1]}, float64(z))
+	scale := svgSize / math.Max(corner[0]-origin[0], corner[1]-origin[1])
+	project := func(p orb.Point) orb.Point {
+		w := worldPixel(p, float64(z))
+		return orb.Point{(w[0] - origin[0]) * scale, (w[1] - origin[1]) * scale}
+	}
+
+	var areas, roads, buildings, labels bytes.Buffer
+	var highlight *geojson.Feature
+
+	for _, l := range layers {
+		for _, f := range l.Features {
+			g := projectGeometry(f.Geometry, project)
+			_, isBuilding := f.Properties["building"]
+
+			if id, _ := f.Properties["merge_id"].(string); id == mergeId {
+				if highlight == nil {
+					highlight = geojson.NewFeature(nil)
+					highlight.Properties = f.Properties
+				}
+				continue
+			}
+
+			switch {
+			case g.Dimensions() == 2 && isBuilding:
+				fmt.Fprintf(&buildings, `<path d="%s" fill="%s"/>`+"\n", svgPath(g), svgColor(f.Properties["color"], theme.Building))
+			case g.Dimensions() == 2:
+				fmt.Fprintf(&areas, `<path d="%s"/>`+"\n", svgPath(g))
+			case g.Dimensions() == 1:
+				fmt.Fprintf(&roads, `<path d="%s"/>`+"\n", svgPath(g))
+			}
+
+			if g.Dimensions() == 2 {
+				svgLabel(&labels, f.Properties, g, theme)
+			}
+		}
+	}
+
+	outline := projectGeometry(stitchGeometries(pieces), project)
+	highlightColor := svgColor(highlight.Properties["color"], theme.CustomText)
+
+	var svg bytes.Buffer
+	width, height := (corner[0]-origin[0])*scale, (corner[1]-origin[1])*scale
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.1f %.1f">`+"\n", width, height, width, height)
+	fmt.Fprintf(&svg, `<rect id="background" width="100%%" height="100%%" fill="%s"/>`+"\n", theme.Background)
+	fmt.Fprintf(&svg, `<g id="areas" fill="%s" fill-rule="evenodd">`+"\n%s</g>\n", theme.Area, areas.String())
+	fmt.Fprintf(&svg, `<g id="roads" fill="none" stroke="%s" stroke-width="2" stroke-linecap="round" stroke-linejoin="round">`+"\n%s</g>\n", theme.Road, roads.String())
+	fmt.Fprintf(&svg, `<g id="buildings" stroke="%s" stroke-width="0.5" fill-rule="evenodd">`+"\n%s</g>\n", theme.BuildingLine, buildings.String())
+	fmt.Fprintf(&svg, `<g id="feature" data-merge-id="%s" fill="%s" fill-opacity="0.6" stroke="%s" stroke-width="3" stroke-linejoin="round" fill-rule="evenodd">`+"\n",
+		svgEscape(mergeId), highlightColor, highlightColor)
+	if outline.Dimensions() == 2 {
+		fmt.Fprintf(&svg, `<path d="%s"/>`+"\n", svgPath(outline))
+	} else {
+		fmt.Fprintf(&svg, `<path d="%s" fill="none"/>`+"\n", svgPath(outline))
+	}
+	svg.WriteString("</g>\n")
+	if outline.Dimensions() == 2 {
+		svgLabel(&labels, highlight.Properties, outline, theme)
+	}
+	fmt.Fprintf(&svg, `<g id="labels" font-family="Open Sans, sans-serif" text-anchor="middle" paint-order="stroke" stroke="%s" stroke-linejoin="round">`+"\n%s</g>\n", theme.TextHalo, labels.String())
+	svg.WriteString("</svg>\n")
+
+	return svg.Bytes(), true, nil
+}
+
+// svgLabel follows the label layers of GetStyle: custom names are bold in the
+// custom text color with the original name below them, other names are plain.
+func svgLabel(buf *bytes.Buffer, properties geojson.Properties, g orb.Geometry, theme styleTheme) {
+	name, _ := properties["name"].(string)
+	if name == "" {
+		return
+	}
+	center, _ := planar.CentroidArea(g)
+
+	osmName, customName := properties["osm_name"].(string)
+	if !customName {
+		fmt.Fprintf(buf, `<text x="%.1f" y="%.1f" font-size="12" fill="%s" stroke-width="2">%s</text>`+"\n",
+			center[0], center[1], theme.Text, svgEscape(name))
+		return
+	}
+
+	fmt.Fprintf(buf, `<text x="%.1f" y="%.1f" font-size="13" font-weight="bold" fill="%s" stroke-width="3">%s`,
+		center[0], center[1], theme.CustomText, svgEscape(name))
+	if osmName != "" {
+		fmt.Fprintf(buf, `<tspan x="%.1f" dy="1.2em" font-size="0.8em">%s</tspan>`, center[0], svgEscape(osmName))
+	}
+	buf.WriteString("</text>\n")
+}
+
+// svgPath writes lines and polygon rings as SVG path data.
+func svgPath(g orb.Geometry) string {
+	var sb strings.Builder
+	add := func(ps []orb.Point, closed bool) {
+		for i, p := range ps {
+			if i == 0 {
+				fmt.Fprintf(&sb, "M%.1f %.1f", p[0], p[1])
+			} else {
+				fmt.Fprintf(&sb, "L%.1f %.1f", p[0], p[1])
+			}
+		}
+		if closed && len(ps) > 0 {
+			sb.WriteString("Z")
+		}
+	}
+
+	switch g := g.(type) {
+	case orb.LineString:
+		add(g, false)
+	case orb.MultiLineString:
+		for _, ls := range g {
+			add(ls, false)
+		}
+	case orb.Polygon:
+		for _, r := range g {
+			add(r, true)
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			for _, r := range p {
+				add(r, true)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// svgColor passes through the palette colors the overlay writes and falls
+// back to the theme color for anything else, so no property reaches the
+// document unescaped.
+func svgColor(value interface{}, fallback string) string {
+	if s, ok := value.(string); ok {
+		for _, c := range featureColorPalette {
+			if strings.EqualFold(c, s) {
+				return c
+			}
+		}
+	}
+	return fallback
+}
+
+func svgEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// GetFeatureSVG serves /features/{mergeId}/svg
+func (fi FeatureInterceptor) GetFeatureSVG(rw http.ResponseWriter, req *http.Request) {
+	mergeId := mux.Vars(req)["mergeId"]
+
+	z, err := fi.geometryZoom(req)
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	theme, err := staticTheme(req)
+	if err != nil {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	elasticElement, found := fi.s.getElasticElement(mergeId)
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	svg, found, err := fi.FeatureSVG(mergeId, elementBound(elasticElement), z, theme)
+	if err == errTooManyTiles {
+		http.Error(rw, "Request Error "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("svg of %s: %v", mergeId, err)
+		http.Error(rw, "could not render feature", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "image/svg+xml")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(svg)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+)
+
+// TileCache keeps rendered tiles on disk as {Dir}/{z}/{x}/{y}.mvt, in the
+// same (usually gzipped) encoding they are served with. Filtered variants of
+// a tile live under {Dir}/variants/{variant}/{z}/{x}/{y}.mvt.
+//
+// Tiles overzoomed past MaxZoom, the tileset max zoom, are grouped under the
+// tile at MaxZoom they are cut from, as
+// {Dir}/overzoom/{MaxZoom}/{ax}/{ay}/{z}/{x}/{y}.mvt, so invalidating that
+// tile removes all of them with one directory.
+type TileCache struct {
+	Dir     string
+	MaxZoom uint8
+}
+
+const (
+	tileCacheVariantsDir = "variants"
+	tileCacheOverzoomDir = "overzoom"
+)
+
+func (c *TileCache) path(variant string, z uint8, x uint64, y uint64) string {
+	tile := filepath.Join(fmt.Sprint(z), fmt.Sprint(x), fmt.Sprintf("%d.mvt", y))
+	if z > c.MaxZoom {
+		shift := z - c.MaxZoom
+		tile = filepath.Join(c.overzoomDir(c.MaxZoom, x>>shift, y>>shift), tile)
+	}
+	if variant == "" {
+		return filepath.Join(c.Dir, tile)
+	}
+	return filepath.Join(c.Dir, tileCacheVariantsDir, variant, tile)
+}
+
+// overzoomDir is the directory, relative to a variant, holding the tiles
+// overzoomed from the tile z/x/y.
+func (c *TileCache) overzoomDir(z uint8, x uint64, y uint64) string {
+	return filepath.Join(tileCacheOverzoomDir, fmt.Sprint(z), fmt.Sprint(x), fmt.Sprint(y))
+}
+
+func (c *TileCache) Get(variant string, z uint8, x uint64, y uint64) ([]byte, bool) {
+	data, err := ioutil.ReadFile(c.path(variant, z, x, y))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Put writes the tile through a temporary file, so readers never see a
+// partially written tile.
+func (c *TileCache) Put(variant string, z uint8, x uint64, y uint64, data []byte) error {
+	path := c.path(variant, z, x, y)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tile-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Invalidate removes the tile and all of its filtered variants. At MaxZoom it
+// also removes every tile overzoomed from it.
+func (c *TileCache) Invalidate(z uint8, x uint64, y uint64) {
+	paths, _ := filepath.Glob(c.path("*", z, x, y))
+	paths = append(paths, c.path("", z, x, y))
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("invalidating cached tile %d/%d/%d: %v", z, x, y, err)
+		}
+	}
+
+	if z != c.MaxZoom {
+		return
+	}
+
+	overzoomed := c.overzoomDir(z, x, y)
+	dirs, _ := filepath.Glob(filepath.Join(c.Dir, tileCacheVariantsDir, "*", overzoomed))
+	dirs = append(dirs, filepath.Join(c.Dir, overzoomed))
+
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("invalidating tiles overzoomed from %d/%d/%d: %v", z, x, y, err)
+		}
+	}
+}
+
+// tileRange returns the tiles at zoom z that cover the bound, clamped to the
+// valid web mercator latitudes.
+func tileRange(bound orb.Bound, z uint8) (minX, minY, maxX, maxY uint64) {
+	clampLat := func(lat float64) float64 {
+		return math.Max(-85.0511, math.Min(85.0511, lat))
+	}
+
+	topLeft := maptile.At(orb.Point{bound.Min[0], clampLat(bound.Max[1])}, maptile.Zoom(z))
+	bottomRight := maptile.At(orb.Point{bound.Max[0], clampLat(bound.Min[1])}, maptile.Zoom(z))
+	return uint64(topLeft.X), uint64(topLeft.Y), uint64(bottomRight.X), uint64(bottomRight.Y)
+}
+
+// elementBound is the bounding box of a search index element. The box is
+// stored as two lat/long corners, so take the extremes of both.
+func elementBound(element *IndexableElement) orb.Bound {
+	bb := element.BoundingBox
+	return orb.Bound{
+		Min: orb.Point{math.Min(bb[1], bb[3]), math.Min(bb[0], bb[2])},
+		Max: orb.Point{math.Max(bb[1], bb[3]), math.Max(bb[0], bb[2])},
+	}
+}
+
+// invalidateTiles drops every cached tile that may contain the element. Only
+// the stored zoom levels are walked: overzoomed tiles go with their tile at
+// the tileset max zoom.
+func (fi FeatureInterceptor) invalidateTiles(element *IndexableElement) {
+	if fi.tileCache == nil {
+		return
+	}
+
+	bound := elementBound(element)
+	minZoom, maxZoom := fi.tiles.ZoomRange()
+	for z := int(minZoom); z <= int(maxZoom); z++ {
+		minX, minY, maxX, maxY := tileRange(bound, uint8(z))
+		for x := minX; x <= maxX; x++ {
+			for y := minY; y <= maxY; y++ {
+				fi.tileCache.Invalidate(uint8(z), x, y)
+			}
+		}
+	}
+}
+
+// viewInvalidationInterval is how often tiles whose output changed with the
+// view count of a feature are invalidated. Views come in on every feature
+// request, so they are batched rather than invalidated on the request.
+const viewInvalidationInterval = time.Minute
+
+// pendingInvalidations collects elements whose cached tiles are out of date.
+type pendingInvalidations struct {
+	mu       sync.Mutex
+	elements map[string]*IndexableElement
+}
+
+func newPendingInvalidations() *pendingInvalidations {
+	return &pendingInvalidations{elements: make(map[string]*IndexableElement)}
+}
+
+func (p *pendingInvalidations) add(element *IndexableElement) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.elements[element.Merge_id] = element
+}
+
+func (p *pendingInvalidations) take() map[string]*IndexableElement {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elements := p.elements
+	p.elements = make(map[string]*IndexableElement)
+	return elements
+}
+
+// flushViewInvalidations reports the pending elements as changed every
+// interval, so each feature costs at most one invalidation and one change
+// feed entry per interval.
+func (fi FeatureInterceptor) flushViewInvalidations(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, element := range fi.viewInvalidations.take() {
+			fi.tilesChanged(element)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestTileCacheInvalidateOverzoomed(t *testing.T) {
+	cache := &TileCache{Dir: t.TempDir(), MaxZoom: 14}
+
+	tiles := []struct {
+		variant string
+		z       uint8
+		x, y    uint64
+	}{
+		{"", 14, 4577, 5980},
+		{"", 15, 9154, 11960},
+		{"", 18, 73239, 95683},
+		{"abc", 16, 18310, 23922},
+		{"", 15, 9156, 11960}, // cut from 14/4578/5980
+		{"", 13, 2288, 2990},
+	}
+	for _, tile := range tiles {
+		if err := cache.Put(tile.variant, tile.z, tile.x, tile.y, []byte("tile")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.Invalidate(14, 4577, 5980)
+
+	for i, tile := range tiles {
+		_, ok := cache.Get(tile.variant, tile.z, tile.x, tile.y)
+		if want := i >= 4; ok != want {
+			t.Errorf("tile %s %d/%d/%d cached %v, want %v", tile.variant, tile.z, tile.x, tile.y, ok, want)
+		}
+	}
+}
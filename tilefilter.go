@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/paulmach/orb/encoding/mvt"
+)
+
+// tileFilter keeps only some layers and properties of a tile, for clients
+// like the minimap that need a fraction of the data. A nil set keeps all.
+type tileFilter struct {
+	layers map[string]bool
+	fields map[string]bool
+}
+
+// parseTileFilter reads the comma separated layers= and fields= parameters.
+func parseTileFilter(query url.Values) tileFilter {
+	return tileFilter{
+		layers: parseNameSet(query.Get("layers")),
+		fields: parseNameSet(query.Get("fields")),
+	}
+}
+
+// tileSchema holds the layer and field names a tile filter may ask for. The
+// fields are nil when the tileset metadata does not declare them.
+type tileSchema struct {
+	layers map[string]bool
+	fields map[string]bool
+}
+
+// newTileSchema reads the vector_layers of the tileset metadata, together
+// with the layers and properties the server adds to tiles itself.
+func newTileSchema(metadata map[string]interface{}) tileSchema {
+	schema := tileSchema{layers: map[string]bool{clusterLayerName: true}}
+	for _, id := range vectorLayerIds(metadata) {
+		schema.layers[id] = true
+	}
+
+	vectorLayers, _ := metadata["vector_layers"].([]interface{})
+	for _, l := range vectorLayers {
+		layer, _ := l.(map[string]interface{})
+		fields, _ := layer["fields"].(map[string]interface{})
+		for name := range fields {
+			if schema.fields == nil {
+				schema.fields = make(map[string]bool)
+			}
+			schema.fields[name] = true
+		}
+	}
+
+	if schema.fields != nil {
+		added := append([]string{"merge_id", "osm_name", "count", "top_merge_id", "top_name"}, tileOverlayProperties...)
+		for _, name := range added {
+			schema.fields[name] = true
+		}
+	}
+	return schema
+}
+
+// validate rejects filters naming layers or fields the tiles do not have, so
+// that every cached variant is one of a bounded set.
+func (schema tileSchema) validate(f tileFilter) error {
+	for name := range f.layers {
+		if !schema.layers[name] {
+			return fmt.Errorf("unknown tile layer %q", name)
+		}
+	}
+	if schema.fields == nil {
+		return nil
+	}
+	for name := range f.fields {
+		if !schema.fields[name] {
+			return fmt.Errorf("unknown tile field %q", name)
+		}
+	}
+	return nil
+}
+
+// cacheable tells whether the filtered variant may be stored in the tile
+// cache. Field names can only be checked when the tileset declares them, so
+// field filters on other tilesets are cut on every request instead.
+func (schema tileSchema) cacheable(f tileFilter) bool {
+	return f.fields == nil || schema.fields != nil
+}
+
+func parseNameSet(list string) map[string]bool {
+	var set map[string]bool
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[name] = true
+	}
+	return set
+}
+
+func (f tileFilter) empty() bool {
+	return f.layers == nil && f.fields == nil
+}
+
+// key names the filter in the tile cache. Equal filters get the same key
+// regardless of parameter order.
+func (f tileFilter) key() string {
+	if f.empty() {
+		return ""
+	}
+
+	canonical := fmt.Sprintf("layers=%s;fields=%s", sortedNames(f.layers), sortedNames(f.fields))
+	sum := sha1.Sum([]byte(canonical))
+	return hex.EncodeToString(sum[:8])
+}
+
+func sortedNames(set map[string]bool) string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (f tileFilter) apply(layers mvt.Layers) mvt.Layers {
+	result := make(mvt.Layers, 0, len(layers))
+
+	for _, l := range layers {
+		if f.layers != nil && !f.layers[l.Name] {
+			continue
+		}
+
+		if f.fields != nil {
+			for _, feature := range l.Features {
+				for name := range feature.Properties {
+					if !f.fields[name] {
+						delete(feature.Properties, name)
+					}
+				}
+			}
+		}
+		result = append(result, l)
+	}
+	return result
+}
+
+func (f tileFilter) applyGzipped(tile []byte) ([]byte, error) {
+	var layers mvt.Layers
+	var err error
+	if isGzipped(tile) {
+		layers, err = mvt.UnmarshalGzipped(tile)
+	} else {
+		layers, err = mvt.Unmarshal(tile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding tile: %v", err)
+	}
+
+	resultTile, err := mvt.MarshalGzipped(f.apply(layers))
+	if err != nil {
+		return nil, fmt.Errorf("encoding tile: %v", err)
+	}
+	return resultTile, nil
+}
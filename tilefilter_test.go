@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestTileSchemaValidate(t *testing.T) {
+	declared := newTileSchema(map[string]interface{}{
+		"vector_layers": []interface{}{
+			map[string]interface{}{"id": "building", "fields": map[string]interface{}{"height": "Number"}},
+			map[string]interface{}{"id": "road", "fields": map[string]interface{}{"class": "String"}},
+		},
+	})
+	undeclared := newTileSchema(map[string]interface{}{
+		"vector_layers": []interface{}{
+			map[string]interface{}{"id": "building"},
+		},
+	})
+
+	tests := []struct {
+		name      string
+		schema    tileSchema
+		query     string
+		wantErr   string
+		cacheable bool
+	}{
+		{"no filter", declared, "", "", true},
+		{"known layers", declared, "layers=building,road", "", true},
+		{"unknown layer", declared, "layers=building,water", `unknown tile layer "water"`, true},
+		{"known fields", declared, "fields=height,class", "", true},
+		{"added fields", declared, "fields=merge_id,osm_name,color", "", true},
+		{"cluster layer and fields", declared, "layers=clusters&fields=count,top_merge_id,top_name", "", true},
+		{"unknown field", declared, "fields=height,password", `unknown tile field "password"`, true},
+		{"blank names are ignored", declared, "layers=,building,&fields= ,height", "", true},
+		{"fields without declared fields", undeclared, "fields=anything", "", false},
+		{"layers without declared fields", undeclared, "layers=building", "", true},
+		{"unknown layer without declared fields", undeclared, "layers=road", `unknown tile layer "road"`, true},
+	}
+
+	for _, test := range tests {
+		query, err := url.ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter := parseTileFilter(query)
+
+		err = test.schema.validate(filter)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.wantErr)
+		}
+		if got := test.schema.cacheable(filter); got != test.cacheable {
+			t.Errorf("%s: cacheable %v, want %v", test.name, got, test.cacheable)
+		}
+	}
+}
+
+func TestTileFilterKey(t *testing.T) {
+	key := func(query string) string {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parseTileFilter(values).key()
+	}
+
+	if k := key(""); k != "" {
+		t.Errorf("unfiltered key %q, want empty", k)
+	}
+	if key("layers=a,b&fields=x,y") != key("fields=y,x&layers=b,a") {
+		t.Error("key depends on parameter order")
+	}
+	if key("layers=a") == key("fields=a") {
+		t.Error("layer and field filters share a key")
+	}
+}
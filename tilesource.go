@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// TileSource is a read-only tile store addressed by XYZ tile coordinates.
+// GetTileData returns the gzipped vector tile, or nil when the tile is missing.
+// Metadata returns the TileJSON style description of the tileset, including
+// its vector_layers. ForEachTile calls fn with the XYZ coordinates of every
+// tile stored in the tileset and stops at the first error.
+type TileSource interface {
+	GetTileData(z uint8, x uint64, y uint64) ([]byte, error)
+	ZoomRange() (uint8, uint8)
+	Metadata() (map[string]interface{}, error)
+	ForEachTile(fn func(z uint8, x uint64, y uint64) error) error
+}
+
+// vectorLayerIds lists the source layer ids declared in the tileset metadata.
+func vectorLayerIds(metadata map[string]interface{}) []string {
+	ids := make([]string, 0)
+	layers, _ := metadata["vector_layers"].([]interface{})
+	for _, l := range layers {
+		layer, _ := l.(map[string]interface{})
+		if id, ok := layer["id"].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// OpenTileSource picks the tile source implementation from the file extension.
+func OpenTileSource(filename string) (TileSource, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".pmtiles":
+		return NewPMTiles(filename)
+	default:
+		return NewDB(filename)
+	}
+}
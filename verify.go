@@ -0,0 +1,190 @@
+package main
+
+import (
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// VerifyRequestDto asks whether signature signs payload, either by the master
+// key KeyId or by an account key for the feature MergeId. Standard, Nonce and
+// Recipient work as for owner requests, so NEP-413 signatures verify too.
+type VerifyRequestDto struct {
+	Payload         string `json:"payload"`
+	PayloadEncoding string `json:"payload_encoding"`
+	KeyId           string `json:"key_id"`
+	MergeId         string `json:"merge_id"`
+	SignatureDto
+}
+
+// VerifyResultDto reports the key that matched and, for features, whose key
+// it is and whether that account owns the feature now. Reason explains a
+// failed verification.
+type VerifyResultDto struct {
+	Valid          bool   `json:"valid"`
+	KeyId          string `json:"key_id,omitempty"`
+	PublicKey      string `json:"public_key,omitempty"`
+	Account        string `json:"account,omitempty"`
+	Owner          string `json:"owner,omitempty"`
+	IsCurrentOwner *bool  `json:"is_current_owner,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// Verifier checks signatures by the FeatureSigner keys or by feature owners
+// for third parties, following the same conventions as the server itself.
+type Verifier struct {
+	fi     *FeatureInterceptor
+	signer *FeatureSigner
+}
+
+func decodePayload(payload string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "utf8":
+		return []byte(payload), nil
+	case "base64":
+		return b64.StdEncoding.DecodeString(payload)
+	case "hex":
+		return hex.DecodeString(payload)
+	default:
+		return nil, fmt.Errorf("unknown payload encoding %q", encoding)
+	}
+}
+
+// verifySigner checks the signature against a master key, active or retired.
+func (verifier *Verifier) verifySigner(keyId string, message SignedMessage, signature []byte) VerifyResultDto {
+	if verifier.signer.keys == nil {
+		return VerifyResultDto{Reason: errNoSigningKey.Error()}
+	}
+
+	publicKey, ok := verifier.signer.keys.PublicKey(keyId)
+	if !ok {
+		return VerifyResultDto{Reason: fmt.Sprintf("unknown key id %q", keyId)}
+	}
+	if !verifier.signer.verify(keyId, message, signature) {
+		return VerifyResultDto{KeyId: keyId, Reason: "signature does not match the key"}
+	}
+	return VerifyResultDto{Valid: true, KeyId: keyId, PublicKey: publicKey.String()}
+}
+
+// verifyFeature checks the signature against the full access keys of the
+// current owner of the feature, then against the keys that signed earlier
+// revisions, so signatures of previous owners are told apart from forgeries.
+// The owner is read from NEAR on every call, so a transfer shows at once.
+func (verifier *Verifier) verifyFeature(mergeId string, message SignedMessage, signature []byte) (VerifyResultDto, error) {
+	fi := verifier.fi
+	owner, err := fi.nearInteractor.getOwnerByTokenId(mergeId)
+	if err != nil {
+		log.Printf("reading owner of %s: %v", mergeId, err)
+		return VerifyResultDto{}, errOwnerUnavailable
+	}
+	isCurrentOwner := false
+	result := VerifyResultDto{Owner: owner, IsCurrentOwner: &isCurrentOwner}
+
+	if owner != "" {
+		if publicKey, matched := fi.matchAccountKey(owner, message, signature); matched {
+			result.Valid = true
+			result.PublicKey = publicKey
+			result.Account = owner
+			isCurrentOwner = true
+			return result, nil
+		}
+	}
+
+	signers := make([]FeatureRevision, 0)
+	err = fi.db.Model(&FeatureRevision{}).Distinct("signer", "public_key").
+		Where("merge_id = ? AND public_key <> ''", mergeId).Find(&signers).Error
+	if err != nil {
+		return result, err
+	}
+	for _, signer := range signers {
+		publicKey, err := ParsePublicKey(signer.PublicKey)
+		if err != nil || !publicKey.Verify(message, signature) {
+			continue
+		}
+		result.PublicKey = signer.PublicKey
+		result.Account = signer.Signer
+		if signer.Signer == owner {
+			// a key the owner has since removed from the account
+			result.Reason = "signed by a key that is no longer a full access key of the current owner"
+		} else {
+			result.Reason = fmt.Sprintf("signed by %s, who no longer owns the feature", signer.Signer)
+		}
+		return result, nil
+	}
+
+	if owner == "" {
+		result.Reason = "feature is not minted and no earlier owner key matches"
+	} else {
+		result.Reason = "signature does not match any full access key of the current owner"
+	}
+	return result, nil
+}
+
+// HandleVerify serves POST /verify.
+func (verifier *Verifier) HandleVerify(rw http.ResponseWriter, req *http.Request) {
+	var dto VerifyRequestDto
+	json.NewDecoder(req.Body).Decode(&dto)
+	if dto.Payload == "" || dto.Signature == "" {
+		http.Error(rw, "Request Error payload and signature are required", http.StatusBadRequest)
+		return
+	}
+	if (dto.KeyId == "") == (dto.MergeId == "") {
+		http.Error(rw, "Request Error exactly one of key_id and merge_id is required", http.StatusBadRequest)
+		return
+	}
+
+	var result VerifyResultDto
+	payload, err := decodePayload(dto.Payload, dto.PayloadEncoding)
+	if err != nil {
+		result.Reason = fmt.Sprintf("decoding payload: %v", err)
+		writeVerifyResult(rw, result)
+		return
+	}
+
+	var message SignedMessage
+	var signature []byte
+	if dto.Standard == signatureStandardNEP413 {
+		// partner apps have wallets sign for their own recipient, not for the
+		// master account, so the recipient is the one of the request
+		if dto.Recipient == "" {
+			result.Reason = "recipient is required for NEP-413 signatures"
+			writeVerifyResult(rw, result)
+			return
+		}
+		message, signature, err = nep413SignedBytes(dto.SignatureDto, payload, dto.Recipient)
+	} else {
+		message, signature, err = verifier.fi.signedBytes(dto.SignatureDto, payload)
+	}
+	if err != nil {
+		result.Reason = err.Error()
+		writeVerifyResult(rw, result)
+		return
+	}
+
+	if dto.KeyId != "" {
+		writeVerifyResult(rw, verifier.verifySigner(dto.KeyId, message, signature))
+		return
+	}
+
+	result, err = verifier.verifyFeature(dto.MergeId, message, signature)
+	if err == errOwnerUnavailable {
+		http.Error(rw, "could not read token owner", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("verifying signature for %s: %v", dto.MergeId, err)
+		http.Error(rw, "could not verify signature", http.StatusInternalServerError)
+		return
+	}
+	writeVerifyResult(rw, result)
+}
+
+func writeVerifyResult(rw http.ResponseWriter, result VerifyResultDto) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(&result)
+	rw.Write(body)
+}
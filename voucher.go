@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	b58 "github.com/mr-tron/base58/base58"
+	"gorm.io/gorm"
+)
+
+const mintVoucherHeader = "shizo-mint-voucher:v1"
+
+var (
+	errAlreadyMinted     = errors.New("feature is already minted")
+	errVoucherReserved   = errors.New("feature has an unexpired voucher for another account")
+	errVoucherLimit      = errors.New("voucher limit reached for this account")
+	errOwnerUnavailable  = errors.New("could not check whether the feature is minted")
+	errInvalidMintPrice  = errors.New("mint price must be a non-negative integer amount of yoctoNEAR")
+	mintVoucherLimitSpan = 24 * time.Hour
+)
+
+// MintRules decide who gets a mint voucher and on what terms.
+type MintRules struct {
+	// Price in yoctoNEAR, as a decimal string
+	Price string
+	// VoucherTTL is how long a voucher can be redeemed
+	VoucherTTL time.Duration
+	// PerAccountLimit caps the vouchers issued to an account within
+	// mintVoucherLimitSpan, unlimited when zero
+	PerAccountLimit int
+}
+
+func parseMintPrice(price string) (string, error) {
+	n, ok := new(big.Int).SetString(price, 10)
+	if !ok || n.Sign() < 0 {
+		return "", errInvalidMintPrice
+	}
+	return n.String(), nil
+}
+
+type MintVoucherDto struct {
+	MergeId   string `json:"merge_id"`
+	Recipient string `json:"recipient"`
+	Price     string `json:"price"`
+	Nonce     string `json:"nonce"`
+	Expires   int64  `json:"expires"`
+	KeyId     string `json:"key_id"`
+	Signature string `json:"signature"`
+}
+
+// voucherMessage is what the master key signs and the contract checks before
+// minting, lines separated by a single "\n":
+//
+//	shizo-mint-voucher:v1
+//	key_id:<id of the signing key>
+//	merge_id:<merge_id>
+//	recipient:<account id>
+//	price:<yoctoNEAR>
+//	nonce:<nonce>
+//	expires:<unix seconds>
+func voucherMessage(voucher *MintVoucher) []byte {
+	return []byte(strings.Join([]string{
+		mintVoucherHeader,
+		"key_id:" + voucher.KeyId,
+		"merge_id:" + voucher.MergeId,
+		"recipient:" + voucher.Recipient,
+		"price:" + voucher.Price,
+		"nonce:" + voucher.Nonce,
+		fmt.Sprintf("expires:%d", voucher.ExpiresAt.Unix()),
+	}, "\n"))
+}
+
+func (voucher *MintVoucher) dto() *MintVoucherDto {
+	return &MintVoucherDto{
+		MergeId:   voucher.MergeId,
+		Recipient: voucher.Recipient,
+		Price:     voucher.Price,
+		Nonce:     voucher.Nonce,
+		Expires:   voucher.ExpiresAt.Unix(),
+		KeyId:     voucher.KeyId,
+		Signature: voucher.Signature,
+	}
+}
+
+// issueVoucher applies the mint rules and records the signed voucher. An
+// unexpired voucher of the same recipient is handed out again instead of a
+// new one, so retries do not eat into the account limit.
+func (featureSigner *FeatureSigner) issueVoucher(mergeId string, recipient string) (*MintVoucher, error) {
+	owner, err := featureSigner.nearInteractor.getOwnerByTokenId(mergeId)
+	if err != nil {
+		log.Printf("checking whether %s is minted: %v", mergeId, err)
+		return nil, errOwnerUnavailable
+	}
+	if owner != "" {
+		return nil, errAlreadyMinted
+	}
+
+	var voucher *MintVoucher
+	err = featureSigner.db.Transaction(func(tx *gorm.DB) error {
+		// serialize issuing per feature and per account, so the checks below hold
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?)), pg_advisory_xact_lock(hashtext(?))", "voucher:"+mergeId, "voucher-account:"+recipient).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		active := make([]MintVoucher, 0)
+		if err := tx.Where("merge_id = ? AND expires_at > ?", mergeId, now).Order("id desc").Find(&active).Error; err != nil {
+			return err
+		}
+		for i := range active {
+			if active[i].Recipient != recipient {
+				return errVoucherReserved
+			}
+		}
+		if len(active) > 0 {
+			voucher = &active[0]
+			return nil
+		}
+
+		if featureSigner.rules.PerAccountLimit > 0 {
+			var issued int64
+			err := tx.Model(&MintVoucher{}).
+				Where("recipient = ? AND created_at > ?", recipient, now.Add(-mintVoucherLimitSpan)).
+				Count(&issued).Error
+			if err != nil {
+				return err
+			}
+			if issued >= int64(featureSigner.rules.PerAccountLimit) {
+				return errVoucherLimit
+			}
+		}
+
+		nonce, err := randomToken()
+		if err != nil {
+			return err
+		}
+
+		voucher = &MintVoucher{
+			MergeId:   mergeId,
+			Recipient: recipient,
+			Price:     featureSigner.rules.Price,
+			Nonce:     nonce,
+			ExpiresAt: now.Add(featureSigner.rules.VoucherTTL),
+		}
+		key, err := featureSigner.signingKey()
+		if err != nil {
+			return err
+		}
+		voucher.KeyId = key.ID
+		voucher.Signature = b58.Encode(ed25519.Sign(key.PrivateKey, voucherMessage(voucher)))
+		return tx.Create(voucher).Error
+	})
+	return voucher, err
+}
+
+// GetFeatureSignature issues a mint voucher for the feature to the account of
+// the caller's session.
+func (featureSigner *FeatureSigner) GetFeatureSignature(rw http.ResponseWriter, req *http.Request) {
+	mergeId := mux.Vars(req)["mergeId"]
+
+	token, ok := bearerToken(req)
+	if !ok {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	session, err := findSession(featureSigner.db, featureSigner.nearInteractor, token)
+	if err == errInvalidSession {
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("reading session: %v", err)
+		http.Error(rw, "could not verify session", http.StatusInternalServerError)
+		return
+	}
+
+	if _, found := featureSigner.s.getElasticElement(mergeId); !found {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	voucher, err := featureSigner.issueVoucher(mergeId, session.AccountId)
+	switch err {
+	case nil:
+	case errAlreadyMinted, errVoucherReserved:
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case errVoucherLimit:
+		http.Error(rw, err.Error(), http.StatusTooManyRequests)
+		return
+	case errNoSigningKey, errOwnerUnavailable:
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+		log.Printf("issuing voucher for %s: %v", mergeId, err)
+		http.Error(rw, "could not issue voucher", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	body, _ := json.Marshal(voucher.dto())
+	rw.Write(body)
+}
+
+// GoneFeatureSignature answers the GET that used to return a bare signature
+// of the merge_id, which any caller could use to mint any feature.
+func (featureSigner *FeatureSigner) GoneFeatureSignature(rw http.ResponseWriter, req *http.Request) {
+	http.Error(rw, "mint vouchers moved to POST /features/{mergeId}/signature/ with a session bearer token", http.StatusGone)
+}